@@ -0,0 +1,173 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/talos-systems/sfyra/pkg/cidr"
+	"github.com/talos-systems/sfyra/pkg/lock"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+// network is the bridge network of the part of the environment.
+type network struct {
+	name string
+	cidr *string
+	// enabled networks are used by the parts of the environment enabled in the options.
+	enabled bool
+	// tests networks belong to the parts created by the tests rather than by `up`.
+	tests bool
+}
+
+// allocation selects the networks the command allocates for `auto` CIDRs.
+type allocation int
+
+const (
+	// allocateNone keeps `auto` CIDRs of the missing parts.
+	allocateNone allocation = iota
+	// allocateTests allocates networks of the parts created by the tests.
+	allocateTests
+	// allocateAll allocates networks of all the enabled parts.
+	allocateAll
+)
+
+func (mode allocation) includes(n network) bool {
+	switch {
+	case !n.enabled:
+		return false
+	case mode == allocateAll:
+		return true
+	case mode == allocateTests:
+		return n.tests
+	default:
+		return false
+	}
+}
+
+// networks returns the networks of all the parts of the environment.
+func (env *environment) networks() []network {
+	options := env.options
+
+	return []network{
+		{name: options.BootstrapClusterName, cidr: &options.BootstrapCIDR, enabled: true},
+		{name: env.managementSetName(), cidr: &options.ManagementCIDR, enabled: true},
+		{name: env.managementUEFISetName(), cidr: &options.ManagementUEFICIDR, enabled: options.ManagementFirmware == string(vm.FirmwareMixed)},
+		{name: env.acceptanceSetName(), cidr: &options.AcceptanceCIDR, enabled: options.AcceptanceNodes > 0, tests: true},
+	}
+}
+
+const (
+	// allocationLockName is the host-wide lock held while the networks are allocated and reserved,
+	// it lives in cidr.ReservationsDir, so it never collides with the environment locks.
+	allocationLockName = "allocation"
+	allocationLockWait = time.Minute
+)
+
+// resolveCIDRs replaces `auto` CIDRs with the CIDRs recorded for the existing environment,
+// or allocates free networks for the missing parts selected by the allocation mode.
+//
+// CIDRs are recorded with the environment when it is created, so that reuse finds the same networks.
+// Allocated networks are reserved under the host-wide lock, so that environments created concurrently
+// never get the same network. CIDRs of the other missing parts stay `auto`.
+//
+// Returned function removes the reservations, it should be called once the command is done:
+// by then the created parts have their networks recorded in the saved state.
+func resolveCIDRs(ctx context.Context, options *Options, allocate allocation) (func() error, error) {
+	env := newEnvironment(options, nil)
+
+	networks := env.networks()
+
+	release := func() error { return nil }
+
+	dir, err := stateDir()
+	if err != nil {
+		return release, err
+	}
+
+	var pending []int
+
+	for i, network := range networks {
+		if *network.cidr != cidr.Auto {
+			continue
+		}
+
+		var saved string
+
+		if saved, err = cidr.Saved(dir, network.name); err != nil {
+			return release, err
+		}
+
+		if saved != "" {
+			*network.cidr = saved
+
+			continue
+		}
+
+		if allocate.includes(network) {
+			pending = append(pending, i)
+		}
+	}
+
+	if len(pending) == 0 {
+		return release, nil
+	}
+
+	allocationLock, err := lock.Acquire(ctx, cidr.ReservationsDir(dir), allocationLockName, allocationLockWait)
+	if err != nil {
+		return release, err
+	}
+
+	defer allocationLock.Release() //nolint: errcheck
+
+	used, err := cidr.Used(dir)
+	if err != nil {
+		return release, err
+	}
+
+	for _, network := range networks {
+		var ipNet *net.IPNet
+
+		if _, ipNet, err = net.ParseCIDR(*network.cidr); err == nil {
+			used = append(used, ipNet)
+		}
+	}
+
+	var reservedNames []string
+
+	release = func() error {
+		for _, name := range reservedNames {
+			if releaseErr := cidr.Release(dir, name); releaseErr != nil {
+				return releaseErr
+			}
+		}
+
+		return nil
+	}
+
+	for _, i := range pending {
+		var allocated *net.IPNet
+
+		if allocated, err = cidr.Allocate(cidr.Pool, used); err != nil {
+			return release, err
+		}
+
+		if err = cidr.Reserve(dir, networks[i].name, options.BootstrapClusterName, allocated); err != nil {
+			return release, err
+		}
+
+		reservedNames = append(reservedNames, networks[i].name)
+		used = append(used, allocated)
+
+		*networks[i].cidr = allocated.String()
+
+		fmt.Printf("allocated CIDR %s for %q\n", allocated, networks[i].name)
+	}
+
+	return release, nil
+}
@@ -0,0 +1,314 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// cleanupAction releases a single resource.
+type cleanupAction struct {
+	resource string
+	// teardown actions destroy the environment, they are skipped if the environment should be kept.
+	teardown bool
+	// created reports whether the environment was created by the command (not reused),
+	// it is evaluated when the cleanup runs, as the environment might be recreated after the action is pushed.
+	created func() bool
+	run     func(ctx context.Context) error
+}
+
+// teardownMode selects the teardown actions to be run.
+type teardownMode int
+
+const (
+	// teardownNone keeps the environment.
+	teardownNone teardownMode = iota
+	// teardownCreated destroys the parts of the environment created by the command, reused parts are kept.
+	teardownCreated
+	// teardownAll destroys the whole environment.
+	teardownAll
+)
+
+func (mode teardownMode) includes(action cleanupAction) bool {
+	switch {
+	case !action.teardown:
+		return true
+	case mode == teardownAll:
+		return true
+	case mode == teardownCreated:
+		return action.created != nil && action.created()
+	default:
+		return false
+	}
+}
+
+// cleanupStack is the list of the cleanup actions, actions are run in the reverse order.
+type cleanupStack struct {
+	mu      sync.Mutex
+	actions []cleanupAction
+	running string
+
+	// environments are the names of the qemu provisioner clusters to be force killed.
+	environments []cleanupEnvironment
+}
+
+type cleanupEnvironment struct {
+	name    string
+	created func() bool
+}
+
+// push adds an action which is always run.
+func (stack *cleanupStack) push(resource string, run func(ctx context.Context) error) {
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+
+	stack.actions = append(stack.actions, cleanupAction{resource: resource, run: run})
+}
+
+// pushTeardown adds an action which destroys the environments.
+//
+// Created reports whether the environments were created by the command, so that failed command tears down only
+// what it created.
+// Processes of the environments are force killed if the cleanup is interrupted.
+func (stack *cleanupStack) pushTeardown(resource string, created func() bool, run func(ctx context.Context) error, environments ...string) {
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+
+	stack.actions = append(stack.actions, cleanupAction{resource: resource, teardown: true, created: created, run: run})
+
+	for _, name := range environments {
+		stack.environments = append(stack.environments, cleanupEnvironment{name: name, created: created})
+	}
+}
+
+// pop removes the last action from the stack, it is marked as running.
+func (stack *cleanupStack) pop() (cleanupAction, bool) {
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+
+	if len(stack.actions) == 0 {
+		return cleanupAction{}, false
+	}
+
+	action := stack.actions[len(stack.actions)-1]
+	stack.actions = stack.actions[:len(stack.actions)-1]
+	stack.running = action.resource
+
+	return action, true
+}
+
+// pending returns the resources which were not cleaned up yet.
+func (stack *cleanupStack) pending() []string {
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+
+	resources := make([]string, 0, len(stack.actions)+1)
+
+	if stack.running != "" {
+		resources = append(resources, stack.running)
+	}
+
+	for i := len(stack.actions) - 1; i >= 0; i-- {
+		resources = append(resources, stack.actions[i].resource)
+	}
+
+	return resources
+}
+
+// run the actions in the reverse order, teardown actions are skipped unless selected by the teardown mode.
+//
+// All the actions are run even if some of them fail, resources which were not cleaned up are reported.
+func (stack *cleanupStack) run(ctx context.Context, teardown teardownMode) error {
+	var failed []string
+
+	for {
+		action, ok := stack.pop()
+		if !ok {
+			break
+		}
+
+		if !teardown.includes(action) {
+			continue
+		}
+
+		if err := action.run(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "error cleaning up %s: %s\n", action.resource, err)
+
+			failed = append(failed, action.resource)
+		}
+	}
+
+	stack.mu.Lock()
+	stack.running = ""
+	stack.mu.Unlock()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("resources were not cleaned up: %s (use `down` command to destroy the environment)", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// forceKill kills the processes of the environments selected by the teardown mode with SIGKILL.
+//
+// Network bridges and state directories are left behind, they are cleaned up by the `down` command.
+func (stack *cleanupStack) forceKill(teardown teardownMode) {
+	stack.mu.Lock()
+	environments := append([]cleanupEnvironment(nil), stack.environments...)
+	stack.mu.Unlock()
+
+	dir, err := stateDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error force killing processes: %s\n", err)
+
+		return
+	}
+
+	for _, environment := range environments {
+		if !teardown.includes(cleanupAction{teardown: true, created: environment.created}) {
+			continue
+		}
+
+		var pidPaths []string
+
+		pidPaths, err = filepath.Glob(filepath.Join(dir, environment.name, "*.pid"))
+		if err != nil {
+			continue
+		}
+
+		for _, pidPath := range pidPaths {
+			var pid int
+
+			if pid, err = readPID(pidPath); err != nil {
+				continue
+			}
+
+			// launcher processes are session leaders, so QEMU is killed along with them
+			syscall.Kill(-pid, syscall.SIGKILL) //nolint: errcheck
+			syscall.Kill(pid, syscall.SIGKILL)  //nolint: errcheck
+
+			fmt.Fprintf(os.Stderr, "killed process %d (%s)\n", pid, pidPath)
+		}
+	}
+}
+
+func readPID(path string) (int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(contents)))
+}
+
+// runCommand runs the command and the cleanup stack.
+//
+// First SIGINT/SIGTERM cancels the command context, cleanup is run afterwards.
+// Second signal cancels the cleanup, force kills the processes of the environment (unless it should be kept)
+// and exits immediately.
+//
+// Environment is locked for the commands which change it, lock is held until the cleanup is done.
+//
+// Environment is torn down if the teardown is requested (by the command or -teardown-on-failure-only on failure).
+// With -teardown-on-failure-only failed command tears down only the parts of the environment it created,
+// so that the environment brought up by `up` survives failed `test`.
+func runCommand(cmd command, options *Options) error {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	cleanupCtx, cleanupCtxCancel := context.WithCancel(context.Background())
+	defer cleanupCtxCancel()
+
+	stack := &cleanupStack{}
+
+	teardownOnSuccess := teardownNone
+
+	if cmd.teardown && !options.SkipTeardown {
+		teardownOnSuccess = teardownAll
+	}
+
+	// interrupted command is a failure
+	teardownOnFailure := teardownOnSuccess
+
+	if options.TeardownOnFailureOnly && teardownOnFailure == teardownNone {
+		teardownOnFailure = teardownCreated
+	}
+
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	defer signal.Stop(sigCh)
+
+	go func() {
+		sig := <-sigCh
+
+		fmt.Fprintf(os.Stderr, "received %s, cleaning up (send it again to force kill)\n", sig)
+
+		ctxCancel()
+
+		sig = <-sigCh
+
+		fmt.Fprintf(os.Stderr, "received %s, aborting cleanup\n", sig)
+
+		cleanupCtxCancel()
+
+		stack.forceKill(teardownOnFailure)
+
+		if pending := stack.pending(); len(pending) > 0 {
+			fmt.Fprintf(os.Stderr, "resources were not cleaned up: %s (use `down` command to destroy the environment)\n", strings.Join(pending, ", "))
+		}
+
+		os.Exit(1)
+	}()
+
+	if cmd.lock {
+		envLock, err := lockEnvironment(ctx, options)
+		if err != nil {
+			return err
+		}
+
+		defer envLock.Release() //nolint: errcheck
+	}
+
+	releaseCIDRs, err := resolveCIDRs(ctx, options, cmd.allocate)
+
+	// reservations are removed once the cleanup is done, but before the environment lock is released
+	defer func() {
+		if releaseErr := releaseCIDRs(); releaseErr != nil {
+			fmt.Fprintf(os.Stderr, "error removing CIDR reservations: %s\n", releaseErr)
+		}
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	err = cmd.run(ctx, options, stack)
+
+	teardown := teardownOnSuccess
+
+	if err != nil || ctx.Err() != nil {
+		teardown = teardownOnFailure
+	}
+
+	if cleanupErr := stack.run(cleanupCtx, teardown); cleanupErr != nil {
+		if err == nil {
+			return cleanupErr
+		}
+
+		fmt.Fprintln(os.Stderr, cleanupErr)
+	}
+
+	return err
+}
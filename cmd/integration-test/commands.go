@@ -0,0 +1,345 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+
+	"github.com/talos-systems/sfyra/pkg/bootstrap"
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/cidr"
+	"github.com/talos-systems/sfyra/pkg/lock"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+// command is a subcommand of the integration test.
+type command struct {
+	name        string
+	description string
+	// teardown commands destroy the environment on success (unless -skip-teardown is set).
+	teardown bool
+	// lock commands change the environment, so they hold the environment lock.
+	lock bool
+	// allocate selects the missing parts of the environment the command creates, networks are allocated for them.
+	allocate allocation
+	run      func(ctx context.Context, options *Options, cleanup *cleanupStack) error
+}
+
+// defaultCommand is run if no subcommand is specified.
+var defaultCommand = command{
+	name:        "run",
+	description: "bring up the environment, run the tests and tear down the environment (unless -skip-teardown is set)",
+	teardown:    true,
+	lock:        true,
+	allocate:    allocateAll,
+	run:         runAll,
+}
+
+var commands = []command{
+	defaultCommand,
+	{
+		name:        "up",
+		description: "bring up the bootstrap cluster, the management set of VMs and install the providers",
+		lock:        true,
+		allocate:    allocateAll,
+		run:         runUp,
+	},
+	{
+		name:        "test",
+		description: "run the tests against the existing environment",
+		lock:        true,
+		allocate:    allocateTests,
+		run:         runTest,
+	},
+	{
+		name:        "down",
+		description: "destroy the environment",
+		lock:        true,
+		run:         runDown,
+	},
+	{
+		name:        "status",
+		description: "report which parts of the environment exist and are healthy",
+		run:         runStatus,
+	},
+	{
+		name:        "preflight",
+		description: "check that the host is ready to run the environment",
+		run:         runPreflight,
+	},
+	{
+		name:        "config",
+		description: "manage the config file: `config print-defaults` prints the config file with the default values",
+		run:         runConfig,
+	},
+}
+
+func findCommand(name string) (command, error) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, nil
+		}
+	}
+
+	return command{}, fmt.Errorf("unknown command %q", name)
+}
+
+func runAll(ctx context.Context, options *Options, cleanup *cleanupStack) error {
+	if !options.SkipPreflight {
+		if err := preflightChecks(ctx, options); err != nil {
+			return err
+		}
+	}
+
+	env := newEnvironment(options, cleanup)
+
+	if err := env.setup(ctx, true); err != nil {
+		return err
+	}
+
+	return env.runTests(ctx)
+}
+
+func runUp(ctx context.Context, options *Options, cleanup *cleanupStack) error {
+	if !options.SkipPreflight {
+		if err := preflightChecks(ctx, options); err != nil {
+			return err
+		}
+	}
+
+	return newEnvironment(options, cleanup).setup(ctx, true)
+}
+
+func runTest(ctx context.Context, options *Options, cleanup *cleanupStack) error {
+	env := newEnvironment(options, cleanup)
+
+	if err := env.setup(ctx, false); err != nil {
+		return fmt.Errorf("%w (use `up` to bring up the environment)", err)
+	}
+
+	return env.runTests(ctx)
+}
+
+func runPreflight(ctx context.Context, options *Options, _ *cleanupStack) error {
+	return preflightChecks(ctx, options)
+}
+
+func runConfig(ctx context.Context, options *Options, _ *cleanupStack) error {
+	switch action := flag.Arg(0); action {
+	case "print-defaults":
+		return PrintConfig(os.Stdout, DefaultConfig())
+	case "":
+		return fmt.Errorf("config action is required: print-defaults")
+	default:
+		return fmt.Errorf("unknown config action %q", action)
+	}
+}
+
+func runDown(ctx context.Context, options *Options, _ *cleanupStack) error {
+	env := newEnvironment(options, nil)
+
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	// reservations are left behind if the command which made them was killed
+	for _, network := range env.networks() {
+		if err = cidr.Release(dir, network.name); err != nil {
+			return err
+		}
+	}
+
+	// existing sets are reflected from the provisioner state, CIDRs are not needed
+	for _, name := range []string{env.acceptanceSetName(), env.managementUEFISetName(), env.managementSetName()} {
+		var vmSet *vm.Set
+
+		vmSet, err = vm.NewSet(ctx, vm.Options{
+			Name: name,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = vmSet.Reflect(ctx); err != nil {
+			fmt.Printf("%s\n", err)
+
+			continue
+		}
+
+		fmt.Printf("destroying VM set %q\n", name)
+
+		if err = vmSet.TearDown(ctx); err != nil {
+			return err
+		}
+	}
+
+	bootstrapCluster, err := bootstrap.NewCluster(ctx, bootstrap.Options{
+		Name: options.BootstrapClusterName,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = bootstrapCluster.Reflect(ctx); err != nil {
+		fmt.Printf("%s\n", err)
+
+		return nil
+	}
+
+	fmt.Printf("destroying bootstrap cluster %q\n", options.BootstrapClusterName)
+
+	return bootstrapCluster.TearDown(ctx)
+}
+
+// runStatus reports the state of each part of the environment.
+//
+//nolint: gocyclo
+func runStatus(ctx context.Context, options *Options, _ *cleanupStack) error {
+	const healthTimeout = time.Minute
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+
+	defer w.Flush() //nolint: errcheck
+
+	report := func(component, status string, details ...interface{}) {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", component, status, fmt.Sprint(details...)) //nolint: errcheck
+	}
+
+	env := newEnvironment(options, nil)
+
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	owner, err := lock.Holder(dir, options.BootstrapClusterName)
+	if err != nil {
+		return err
+	}
+
+	if owner != nil {
+		report("lock", "held", owner)
+	} else {
+		report("lock", "free", "")
+	}
+
+	bootstrapCluster, err := bootstrap.NewCluster(ctx, bootstrap.Options{
+		Name: options.BootstrapClusterName,
+	})
+	if err != nil {
+		return err
+	}
+
+	bootstrapExists := false
+
+	if err = bootstrapCluster.Reflect(ctx); err != nil {
+		report("bootstrap cluster", "missing", err)
+	} else {
+		bootstrapExists = true
+
+		checkCtx, checkCtxCancel := context.WithTimeout(ctx, healthTimeout)
+		defer checkCtxCancel()
+
+		if err = bootstrapCluster.Health(checkCtx); err != nil {
+			report("bootstrap cluster", "unhealthy", err)
+		} else {
+			report("bootstrap cluster", "healthy", options.BootstrapClusterName)
+		}
+	}
+
+	for _, name := range []string{env.managementSetName(), env.managementUEFISetName(), env.acceptanceSetName()} {
+		var vmSet *vm.Set
+
+		vmSet, err = vm.NewSet(ctx, vm.Options{
+			Name: name,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = vmSet.Reflect(ctx); err != nil {
+			report("VM set "+name, "missing", err)
+
+			continue
+		}
+
+		if err = vmSet.Health(); err != nil {
+			report("VM set "+name, "unhealthy", err)
+
+			continue
+		}
+
+		report("VM set "+name, "healthy", fmt.Sprintf("%d nodes running", len(vmSet.Nodes())))
+	}
+
+	if !bootstrapExists {
+		return nil
+	}
+
+	clusterAPI, err := capi.NewManager(ctx, bootstrapCluster, capi.Options{})
+	if err != nil {
+		return err
+	}
+
+	defer clusterAPI.Close() //nolint: errcheck
+
+	installed, err := clusterAPI.InstalledProviders(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(installed) == 0 {
+		report("providers", "missing", "no providers installed")
+
+		return nil
+	}
+
+	for _, provider := range installed {
+		report("provider "+provider.Type+" "+provider.ProviderName, "installed", provider.Version)
+	}
+
+	if err = clusterAPI.CheckReady(ctx); err != nil {
+		report("providers", "not ready", err)
+
+		return nil
+	}
+
+	report("providers", "ready", "")
+
+	metalClient, err := clusterAPI.GetMetalClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var servers v1alpha1.ServerList
+
+	if err = metalClient.List(ctx, &servers); err != nil {
+		return err
+	}
+
+	var ready, inUse int
+
+	for _, server := range servers.Items {
+		if server.Status.Ready {
+			ready++
+		}
+
+		if server.Status.InUse {
+			inUse++
+		}
+	}
+
+	report("servers", "registered", fmt.Sprintf("%d servers, %d ready, %d in use", len(servers.Items), ready, inUse))
+
+	return nil
+}
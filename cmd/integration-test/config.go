@@ -4,7 +4,139 @@
 
 package main
 
-import "strings"
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigVersion is the current version of the config file format.
+const ConfigVersion = "v1alpha1"
+
+// testFlags are the flags of the testing package which can be set in the config file.
+var testFlags = []string{"run", "v", "failfast", "timeout", "count"}
+
+// Config is the config file for the integration test.
+//
+// Config file is a YAML document with the options, flags override values from the config file.
+type Config struct {
+	Version string `yaml:"version"`
+
+	Options `yaml:",inline"`
+
+	// Test holds the flags of the testing package without the `test.` prefix, e.g. `run` or `timeout`.
+	Test map[string]string `yaml:"test,omitempty"`
+}
+
+// DefaultConfig returns config with the default options.
+func DefaultConfig() Config {
+	config := Config{
+		Version: ConfigVersion,
+		Options: DefaultOptions(),
+		Test:    map[string]string{},
+	}
+
+	for _, name := range testFlags {
+		if f := flag.Lookup("test." + name); f != nil {
+			config.Test[name] = f.DefValue
+		}
+	}
+
+	return config
+}
+
+// LoadConfig reads the config file and applies it on top of the options.
+//
+// Unknown keys are rejected, so that typos in the config file don't go unnoticed.
+func LoadConfig(path string, options *Options) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	config := Config{
+		Options: *options,
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+
+	if err = decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error loading config %q: %w", path, err)
+	}
+
+	if config.Version != ConfigVersion {
+		return fmt.Errorf("error loading config %q: unsupported version %q, expected %q", path, config.Version, ConfigVersion)
+	}
+
+	for name := range config.Profiles {
+		if !isProfileName(name) {
+			return fmt.Errorf("error loading config %q: unknown node profile %q, expected one of %s", path, name, strings.Join(profileNames, ", "))
+		}
+	}
+
+	for name, value := range config.Test {
+		if err = flag.Set("test."+name, value); err != nil {
+			return fmt.Errorf("error loading config %q: test.%s: %w", path, name, err)
+		}
+	}
+
+	*options = config.Options
+
+	return nil
+}
+
+func isProfileName(name string) bool {
+	for _, profileName := range profileNames {
+		if name == profileName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PrintConfig writes config as YAML document.
+func PrintConfig(w io.Writer, config Config) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(config); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+// configPath finds the value of the config flag in the command line before the flags are parsed.
+//
+// Config is loaded before flags are parsed, so that flags override values from the config file.
+func configPath(args []string) string {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
+			break
+		}
+
+		name := strings.TrimLeft(args[i], "-")
+
+		switch {
+		case name == args[i]:
+			continue
+		case name == "config" && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(name, "config="):
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+
+	return ""
+}
 
 type stringSlice []string
 
@@ -17,3 +149,32 @@ func (ss *stringSlice) Set(value string) error {
 
 	return nil
 }
+
+// overrideSlice replaces the default (or config file) value on the first Set, and appends on subsequent calls.
+type overrideSlice struct {
+	value *stringSlice
+	set   bool
+}
+
+func newOverrideSlice(value *stringSlice) *overrideSlice {
+	return &overrideSlice{
+		value: value,
+	}
+}
+
+func (s *overrideSlice) String() string {
+	if s.value == nil {
+		return ""
+	}
+
+	return s.value.String()
+}
+
+func (s *overrideSlice) Set(value string) error {
+	if !s.set {
+		*s.value = nil
+		s.set = true
+	}
+
+	return s.value.Set(value)
+}
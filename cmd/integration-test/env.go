@@ -0,0 +1,361 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	clientconfig "github.com/talos-systems/talos/pkg/machinery/client/config"
+	clusterctlv1 "sigs.k8s.io/cluster-api/cmd/clusterctl/api/v1alpha3"
+
+	"github.com/talos-systems/sfyra/pkg/bootstrap"
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/state"
+	"github.com/talos-systems/sfyra/pkg/tests"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+// environment is the bootstrap cluster, the management set of VMs and the providers installed into the bootstrap cluster.
+type environment struct {
+	options *Options
+	cleanup *cleanupStack
+
+	offline *offlineServices
+
+	bootstrapCluster *bootstrap.Cluster
+	managementSet    *vm.Set
+	clusterAPI       *capi.Manager
+
+	managementMirrors         []string
+	managementNameservers     []net.IP
+	managementUEFINameservers []net.IP
+	acceptanceNameservers     []net.IP
+}
+
+func newEnvironment(options *Options, cleanup *cleanupStack) *environment {
+	return &environment{
+		options: options,
+		cleanup: cleanup,
+	}
+}
+
+// stateDir is the Talos state directory of the clusters, it holds the provisioner state and the environment locks.
+func stateDir() (string, error) {
+	talosDir, err := clientconfig.GetTalosDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(talosDir, "clusters"), nil
+}
+
+func (env *environment) managementSetName() string {
+	return env.options.BootstrapClusterName + "-management"
+}
+
+// managementUEFISetName is the name of the set of UEFI VMs of the mixed management set, see vm.FirmwareMixed.
+func (env *environment) managementUEFISetName() string {
+	return env.managementSetName() + "-uefi"
+}
+
+func (env *environment) acceptanceSetName() string {
+	return env.options.BootstrapClusterName + "-acceptance"
+}
+
+// setup brings up the environment.
+//
+// If create is false, environment should already exist, otherwise missing parts are created.
+// Cleanup actions are pushed to the cleanup stack as soon as the resources are initialized,
+// so that partially created environment is cleaned up as well.
+func (env *environment) setup(ctx context.Context, create bool) error {
+	options := env.options
+
+	var (
+		bootstrapMirrors     = []string(options.RegistryMirrors)
+		bootstrapNameservers []net.IP
+		err                  error
+	)
+
+	env.managementMirrors = options.RegistryMirrors
+
+	if options.Offline {
+		env.offline, err = startOffline(ctx, options, env.networks())
+		if err != nil {
+			return err
+		}
+
+		env.cleanup.push("offline services", func(context.Context) error {
+			return env.offline.Close()
+		})
+
+		bootstrapMirrors = append(env.offline.registryMirrors(options.BootstrapClusterName), bootstrapMirrors...)
+		env.managementMirrors = append(env.offline.registryMirrors(env.managementSetName()), env.managementMirrors...)
+
+		// each VM set resolves via the responder on its own bridge
+		bootstrapNameservers = env.offline.nameservers(options.BootstrapClusterName)
+		env.managementNameservers = env.offline.nameservers(env.managementSetName())
+		env.managementUEFINameservers = env.offline.nameservers(env.managementUEFISetName())
+		env.acceptanceNameservers = env.offline.nameservers(env.acceptanceSetName())
+	}
+
+	bootstrapProfile := options.nodeProfile(BootstrapProfile)
+
+	env.bootstrapCluster, err = bootstrap.NewCluster(ctx, bootstrap.Options{
+		Name: options.BootstrapClusterName,
+		CIDR: options.BootstrapCIDR,
+
+		Vmlinuz:        options.BootstrapTalosVmlinuz,
+		Initramfs:      options.BootstrapTalosInitramfs,
+		InstallerImage: options.BootstrapTalosInstaller,
+
+		TalosctlPath: options.TalosctlPath,
+
+		RegistryMirrors: bootstrapMirrors,
+		Nameservers:     bootstrapNameservers,
+
+		CPUs:   bootstrapProfile.CPUs,
+		MemMB:  bootstrapProfile.MemMB,
+		DiskGB: bootstrapProfile.DiskGB,
+
+		RecreateOnMismatch: options.RecreateOnMismatch,
+	})
+	if err != nil {
+		return err
+	}
+
+	env.cleanup.pushTeardown(fmt.Sprintf("bootstrap cluster %q", options.BootstrapClusterName), env.bootstrapCluster.Created,
+		env.bootstrapCluster.TearDown, options.BootstrapClusterName)
+
+	if create {
+		err = env.bootstrapCluster.Setup(ctx)
+	} else if err = env.bootstrapCluster.Reflect(ctx); err == nil {
+		err = env.bootstrapCluster.Verify()
+	}
+
+	if err == nil && !create {
+		checkCtx, checkCtxCancel := context.WithTimeout(ctx, 10*time.Minute)
+		defer checkCtxCancel()
+
+		err = env.bootstrapCluster.Health(checkCtx)
+	}
+
+	if err != nil {
+		return mismatchHint(err)
+	}
+
+	managementProfile := options.nodeProfile(ManagementProfile)
+
+	env.managementSet, err = vm.NewSet(ctx, vm.Options{
+		Name:       env.managementSetName(),
+		Nodes:      options.ManagementNodes,
+		BootSource: env.bootstrapCluster.SideroComponentsIP(),
+		CIDR:       options.ManagementCIDR,
+
+		Firmware: vm.Firmware(options.ManagementFirmware),
+		UEFICIDR: options.ManagementUEFICIDR,
+
+		TalosctlPath: options.TalosctlPath,
+
+		Nameservers:     env.managementNameservers,
+		UEFINameservers: env.managementUEFINameservers,
+
+		CPUs:   managementProfile.CPUs,
+		MemMB:  managementProfile.MemMB,
+		DiskGB: managementProfile.DiskGB,
+
+		RecreateOnMismatch: options.RecreateOnMismatch,
+	})
+	if err != nil {
+		return err
+	}
+
+	env.cleanup.pushTeardown(fmt.Sprintf("VM set %q", env.managementSetName()), env.managementSet.Created,
+		env.managementSet.TearDown, env.managementSetName(), env.managementUEFISetName())
+
+	if create {
+		err = env.managementSet.Setup(ctx)
+	} else if err = env.managementSet.Reflect(ctx); err == nil {
+		err = env.managementSet.Verify()
+	}
+
+	if err != nil {
+		return mismatchHint(err)
+	}
+
+	localProviders, err := parseLocalProviders(*options)
+	if err != nil {
+		return err
+	}
+
+	var deploymentPatches []capi.DeploymentPatch
+
+	if options.AcceptanceNodes > 0 {
+		deploymentPatches = append(deploymentPatches, capi.DeploymentPatch{
+			Namespace: "sidero-system",
+			Name:      "sidero-controller-manager",
+			Containers: []capi.ContainerPatch{
+				{
+					Name: "manager",
+					Args: map[string]string{
+						"auto-accept-servers": "false",
+					},
+				},
+			},
+		})
+	}
+
+	env.clusterAPI, err = capi.NewManager(ctx, env.bootstrapCluster, capi.Options{
+		BootstrapProviders:      options.BootstrapProviders,
+		InfrastructureProviders: options.InfrastructureProviders,
+		ControlPlaneProviders:   options.ControlPlaneProviders,
+
+		LocalProviders: localProviders,
+
+		InstallTimeout: options.InstallTimeout,
+
+		DeploymentPatches: deploymentPatches,
+	})
+	if err != nil {
+		return err
+	}
+
+	env.cleanup.push("Cluster API temporary files", func(context.Context) error {
+		return env.clusterAPI.Close()
+	})
+
+	if !create {
+		if options.ReinstallProviders {
+			return fmt.Errorf("-reinstall-providers is supported only by the commands which bring up the environment")
+		}
+
+		return env.clusterAPI.Verify(ctx)
+	}
+
+	if options.ReinstallProviders {
+		if err = env.clusterAPI.Uninstall(ctx, options.ReinstallProvidersCRDs); err != nil {
+			return err
+		}
+	}
+
+	if err = env.clusterAPI.Install(ctx); err != nil {
+		var mismatch *capi.VersionMismatchError
+
+		if errors.As(err, &mismatch) {
+			return fmt.Errorf("%w (use -reinstall-providers to reinstall them)", err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// runTests runs the test suite against the environment.
+//
+// VMs created by the tests are destroyed by the tests, cleanup stack takes care of them if the tests were interrupted.
+func (env *environment) runTests(ctx context.Context) error {
+	options := env.options
+
+	acceptanceProfile := options.nodeProfile(AcceptanceProfile)
+
+	acceptanceSet := vm.Options{
+		Name:       env.acceptanceSetName(),
+		Nodes:      options.AcceptanceNodes,
+		BootSource: env.bootstrapCluster.SideroComponentsIP(),
+		CIDR:       options.AcceptanceCIDR,
+
+		TalosctlPath: options.TalosctlPath,
+
+		Nameservers: env.acceptanceNameservers,
+
+		CPUs:   acceptanceProfile.CPUs,
+		MemMB:  acceptanceProfile.MemMB,
+		DiskGB: acceptanceProfile.DiskGB,
+	}
+
+	if options.AcceptanceNodes > 0 {
+		env.cleanup.push(fmt.Sprintf("VM set %q", acceptanceSet.Name), func(ctx context.Context) error {
+			vmSet, err := vm.NewSet(ctx, acceptanceSet)
+			if err != nil {
+				return err
+			}
+
+			return vmSet.TearDown(ctx)
+		})
+	}
+
+	testNameservers := make([]string, len(env.managementNameservers))
+
+	for i := range env.managementNameservers {
+		testNameservers[i] = env.managementNameservers[i].String()
+	}
+
+	if ok := tests.Run(ctx, env.bootstrapCluster, env.managementSet, env.clusterAPI, tests.Options{
+		KernelURL:      options.TalosKernelURL,
+		InitrdURL:      options.TalosInitrdURL,
+		InstallerImage: options.TalosInstaller,
+
+		UpgradeInstallerImage: options.TalosUpgradeInstaller,
+
+		KubernetesVersion:        options.KubernetesVersion,
+		KubernetesVersionMatrix:  options.KubernetesVersionMatrix,
+		KubernetesUpgradeVersion: options.KubernetesUpgradeVersion,
+
+		MultiClusterCount: options.MultiClusterCount,
+
+		RegistryMirrors: env.managementMirrors,
+		Nameservers:     testNameservers,
+
+		AcceptanceVMSet: acceptanceSet,
+
+		ProvidersUpgrade: capi.UpgradeOptions{
+			BootstrapProviders:      options.UpgradeBootstrapProviders,
+			InfrastructureProviders: options.UpgradeInfrastructureProviders,
+			ControlPlaneProviders:   options.UpgradeControlPlaneProviders,
+		},
+	}); !ok {
+		return fmt.Errorf("test failure")
+	}
+
+	return nil
+}
+
+// mismatchHint suggests to recreate the environment which was created with different options.
+func mismatchHint(err error) error {
+	var mismatch *state.MismatchError
+
+	if errors.As(err, &mismatch) {
+		return fmt.Errorf("%w (bring the environment up with -recreate-on-mismatch to recreate it)", err)
+	}
+
+	return err
+}
+
+func parseLocalProviders(options Options) ([]capi.LocalProvider, error) {
+	var providers []capi.LocalProvider
+
+	for providerType, specs := range map[clusterctlv1.ProviderType][]string{
+		clusterctlv1.CoreProviderType:           options.LocalCoreProviders,
+		clusterctlv1.BootstrapProviderType:      options.LocalBootstrapProviders,
+		clusterctlv1.ControlPlaneProviderType:   options.LocalControlPlaneProviders,
+		clusterctlv1.InfrastructureProviderType: options.LocalInfrastructureProviders,
+	} {
+		for _, spec := range specs {
+			provider, err := capi.ParseLocalProvider(providerType, spec)
+			if err != nil {
+				return nil, err
+			}
+
+			providers = append(providers, provider)
+		}
+	}
+
+	return providers, nil
+}
@@ -0,0 +1,37 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/talos-systems/sfyra/pkg/lock"
+)
+
+// lockEnvironment acquires the lock of the environment, waiting for it up to -wait-for-lock.
+func lockEnvironment(ctx context.Context, options *Options) (*lock.Lock, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	envLock, err := lock.Acquire(ctx, dir, options.BootstrapClusterName, 0)
+
+	var inUse *lock.InUseError
+
+	if errors.As(err, &inUse) && options.WaitForLock > 0 {
+		fmt.Printf("%s, waiting up to %s for it to be released\n", inUse, options.WaitForLock)
+
+		envLock, err = lock.Acquire(ctx, dir, options.BootstrapClusterName, options.WaitForLock)
+	}
+
+	if errors.As(err, &inUse) {
+		return nil, fmt.Errorf("%w (use -wait-for-lock to wait for it to be released, or -bootstrap-cluster-name to use another environment)", err)
+	}
+
+	return envLock, err
+}
@@ -5,119 +5,108 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 	"testing"
-
-	"github.com/talos-systems/talos/pkg/cli"
-
-	"github.com/talos-systems/sfyra/pkg/bootstrap"
-	"github.com/talos-systems/sfyra/pkg/capi"
-	"github.com/talos-systems/sfyra/pkg/tests"
-	"github.com/talos-systems/sfyra/pkg/vm"
 )
 
 func main() {
 	options := DefaultOptions()
 
+	flag.Usage = usage
+
+	// testing flags are registered first, as they can be set in the config file
+	testing.Init()
+
+	config := configPath(os.Args[1:])
+
+	if config != "" {
+		if err := LoadConfig(config, &options); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	flag.String("config", config, "path to the config file (flags override values from the config file)")
 	flag.BoolVar(&options.SkipTeardown, "skip-teardown", options.SkipTeardown, "skip tearing down cluster")
+	flag.BoolVar(&options.TeardownOnFailureOnly, "teardown-on-failure-only", options.TeardownOnFailureOnly, "tear down the parts of the environment created by the command if it failed or was interrupted, -skip-teardown is honored only on success")
+	flag.DurationVar(&options.WaitForLock, "wait-for-lock", options.WaitForLock, "wait for the environment lock held by another run (fail immediately if zero)")
+	flag.BoolVar(&options.SkipPreflight, "skip-preflight", options.SkipPreflight, "skip checking the host before creating the environment")
+	flag.BoolVar(&options.RecreateOnMismatch, "recreate-on-mismatch", options.RecreateOnMismatch, "recreate the reused bootstrap cluster or VM set if it was created with different options")
+	flag.BoolVar(&options.ReinstallProviders, "reinstall-providers", options.ReinstallProviders, "delete providers installed in the reused bootstrap cluster and install them again")
+	flag.BoolVar(&options.ReinstallProvidersCRDs, "reinstall-providers-crds", options.ReinstallProvidersCRDs, "delete provider CRDs (and all Servers, Environments, etc.) when reinstalling providers")
 	flag.StringVar(&options.BootstrapClusterName, "bootstrap-cluster-name", options.BootstrapClusterName, "bootstrap cluster name")
 	flag.StringVar(&options.BootstrapTalosVmlinuz, "bootstrap-vmlinuz", options.BootstrapTalosVmlinuz, "Talos kernel image for bootstrap cluster")
 	flag.StringVar(&options.BootstrapTalosInitramfs, "bootstrap-initramfs", options.BootstrapTalosInitramfs, "Talos initramfs image for bootstrap cluster")
 	flag.StringVar(&options.BootstrapTalosInstaller, "bootstrap-installer", options.BootstrapTalosInstaller, "Talos install image for bootstrap cluster")
-	flag.StringVar(&options.BootstrapCIDR, "bootstrap-cidr", options.BootstrapCIDR, "bootstrap cluster network CIDR")
-	flag.StringVar(&options.ManagementCIDR, "management-cidr", options.ManagementCIDR, "management cluster network CIDR")
+	flag.StringVar(&options.BootstrapCIDR, "bootstrap-cidr", options.BootstrapCIDR, "bootstrap cluster network CIDR (\"auto\" to allocate free network)")
+	flag.StringVar(&options.ManagementCIDR, "management-cidr", options.ManagementCIDR, "management cluster network CIDR (\"auto\" to allocate free network)")
 	flag.IntVar(&options.ManagementNodes, "management-nodes", options.ManagementNodes, "number of PXE nodes to create for the management rack")
+	flag.StringVar(&options.ManagementFirmware, "management-firmware", options.ManagementFirmware, "firmware of the management rack PXE nodes: bios, uefi or mixed (every other node boots UEFI)")
+	flag.StringVar(&options.ManagementUEFICIDR, "management-uefi-cidr", options.ManagementUEFICIDR, "network CIDR of the UEFI nodes of the mixed management rack (\"auto\" to allocate free network)")
+	flag.StringVar(&options.AcceptanceCIDR, "acceptance-cidr", options.AcceptanceCIDR, "server acceptance test network CIDR (\"auto\" to allocate free network)")
+	flag.IntVar(&options.AcceptanceNodes, "acceptance-nodes", options.AcceptanceNodes, "number of PXE nodes to create for the server acceptance test (disables auto-accept in Sidero, test is skipped if zero)")
+	flag.Int64Var(&options.MemMB, "mem-mb", options.MemMB, "memory for each VM (in MiB)")
+	flag.Int64Var(&options.CPUs, "cpus", options.CPUs, "number of CPUs for each VM")
+	flag.Int64Var(&options.DiskGB, "disk-gb", options.DiskGB, "disk size for each VM (in GiB)")
 	flag.StringVar(&options.TalosctlPath, "talosctl-path", options.TalosctlPath, "path to the talosctl (for qemu provisioner)")
-	flag.Var(&options.RegistryMirrors, "registry-mirrors", "registry mirrors to use")
+	flag.Var(newOverrideSlice(&options.RegistryMirrors), "registry-mirrors", "registry mirrors to use")
 	flag.StringVar(&options.TalosKernelURL, "talos-kernel-url", options.TalosKernelURL, "Talos kernel image URL for Cluster API Environment")
 	flag.StringVar(&options.TalosInitrdURL, "talos-initrd-url", options.TalosInitrdURL, "Talos initramfs image URL for Cluster API Environment")
-
-	testing.Init()
-
-	flag.Parse()
-
-	err := cli.WithContext(context.Background(), func(ctx context.Context) error {
-		bootstrapCluster, err := bootstrap.NewCluster(ctx, bootstrap.Options{
-			Name: options.BootstrapClusterName,
-			CIDR: options.BootstrapCIDR,
-
-			Vmlinuz:        options.BootstrapTalosVmlinuz,
-			Initramfs:      options.BootstrapTalosInitramfs,
-			InstallerImage: options.BootstrapTalosInstaller,
-
-			TalosctlPath: options.TalosctlPath,
-
-			RegistryMirrors: options.RegistryMirrors,
-
-			CPUs:   options.CPUs,
-			MemMB:  options.MemMB,
-			DiskGB: options.DiskGB,
-		})
-		if err != nil {
-			return err
-		}
-
-		if !options.SkipTeardown {
-			defer bootstrapCluster.TearDown(ctx) //nolint: errcheck
-		}
-
-		if err = bootstrapCluster.Setup(ctx); err != nil {
-			return err
+	flag.StringVar(&options.TalosInstaller, "talos-installer", options.TalosInstaller, "Talos install image for the workload cluster nodes")
+	flag.Var(newOverrideSlice(&options.BootstrapProviders), "bootstrap-providers", "bootstrap providers to install: name[:version]")
+	flag.Var(newOverrideSlice(&options.ControlPlaneProviders), "control-plane-providers", "control plane providers to install: name[:version]")
+	flag.Var(newOverrideSlice(&options.InfrastructureProviders), "infrastructure-providers", "infrastructure providers to install: name[:version]")
+	flag.DurationVar(&options.InstallTimeout, "install-timeout", options.InstallTimeout, "timeout for the providers to become ready after install")
+	flag.Var(newOverrideSlice(&options.UpgradeBootstrapProviders), "upgrade-bootstrap-providers", "bootstrap providers to upgrade to in the providers upgrade test: name:version")
+	flag.Var(newOverrideSlice(&options.UpgradeControlPlaneProviders), "upgrade-control-plane-providers", "control plane providers to upgrade to in the providers upgrade test: name:version")
+	flag.Var(newOverrideSlice(&options.UpgradeInfrastructureProviders), "upgrade-infrastructure-providers", "infrastructure providers to upgrade to in the providers upgrade test: name:version")
+	flag.Var(newOverrideSlice(&options.LocalCoreProviders), "local-core-provider", "core Cluster API provider from local manifests: cluster-api:version=components.yaml[,metadata.yaml]")
+	flag.Var(newOverrideSlice(&options.LocalBootstrapProviders), "local-bootstrap-provider", "bootstrap provider from local manifests: name:version=components.yaml[,metadata.yaml]")
+	flag.Var(newOverrideSlice(&options.LocalControlPlaneProviders), "local-control-plane-provider", "control plane provider from local manifests: name:version=components.yaml[,metadata.yaml]")
+	flag.Var(newOverrideSlice(&options.LocalInfrastructureProviders), "local-infrastructure-provider", "infrastructure provider from local manifests: name:version=components.yaml[,metadata.yaml]")
+	flag.StringVar(&options.TalosUpgradeInstaller, "talos-upgrade-installer", options.TalosUpgradeInstaller, "Talos install image to upgrade workload cluster node to (upgrade test is skipped if not set)")
+	flag.StringVar(&options.KubernetesVersion, "kubernetes-version", options.KubernetesVersion, "Kubernetes version for the workload cluster")
+	flag.Var(newOverrideSlice(&options.KubernetesVersionMatrix), "kubernetes-version-matrix", "list of Kubernetes versions to deploy the workload cluster with (one cluster per version)")
+	flag.StringVar(&options.KubernetesUpgradeVersion, "kubernetes-upgrade-version", options.KubernetesUpgradeVersion, "Kubernetes version to upgrade the workload cluster to (upgrade test is skipped if not set)")
+	flag.IntVar(&options.MultiClusterCount, "multi-cluster-count", options.MultiClusterCount, "number of workload clusters to deploy concurrently in the multiple clusters test (disabled if zero)")
+	flag.BoolVar(&options.Offline, "offline", options.Offline, "run without outbound network access (local DNS responder and registry)")
+	flag.StringVar(&options.OfflineImagesDir, "offline-images", options.OfflineImagesDir, "directory with image tarballs (docker save) to seed the local registry in offline mode")
+	flag.IntVar(&options.OfflineRegistryPort, "offline-registry-port", options.OfflineRegistryPort, "port for the local registry in offline mode")
+
+	cmd, args := defaultCommand, os.Args[1:]
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		var err error
+
+		if cmd, err = findCommand(args[0]); err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			flag.Usage()
+			os.Exit(2)
 		}
 
-		managementSet, err := vm.NewSet(ctx, vm.Options{
-			Name:       options.BootstrapClusterName + "-management",
-			Nodes:      options.ManagementNodes,
-			BootSource: bootstrapCluster.SideroComponentsIP(),
-			CIDR:       options.ManagementCIDR,
-
-			TalosctlPath: options.TalosctlPath,
-
-			CPUs:   options.CPUs,
-			MemMB:  options.MemMB,
-			DiskGB: options.DiskGB,
-		})
-		if err != nil {
-			return err
-		}
+		args = args[1:]
+	}
 
-		if !options.SkipTeardown {
-			defer managementSet.TearDown(ctx) //nolint: errcheck
-		}
+	flag.CommandLine.Parse(args) //nolint: errcheck
 
-		if err = managementSet.Setup(ctx); err != nil {
-			return err
-		}
+	if err := runCommand(cmd, &options); err != nil {
+		log.Fatal(err)
+	}
+}
 
-		clusterAPI, err := capi.NewManager(ctx, bootstrapCluster, capi.Options{
-			BootstrapProviders:      options.BootstrapProviders,
-			InfrastructureProviders: options.InfrastructureProviders,
-			ControlPlaneProviders:   options.ControlPlaneProviders,
-		})
-		if err != nil {
-			return err
-		}
+func usage() {
+	out := flag.CommandLine.Output()
 
-		if err = clusterAPI.Install(ctx); err != nil {
-			return err
-		}
+	fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0]) //nolint: errcheck
 
-		if ok := tests.Run(ctx, bootstrapCluster, managementSet, clusterAPI, tests.Options{
-			KernelURL:      options.TalosKernelURL,
-			InitrdURL:      options.TalosInitrdURL,
-			InstallerImage: options.TalosInstaller,
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", cmd.name, cmd.description) //nolint: errcheck
+	}
 
-			RegistryMirrors: options.RegistryMirrors,
-		}); !ok {
-			return fmt.Errorf("test failure")
-		}
+	fmt.Fprintf(out, "\nCommand %q is run by default.\n\nFlags:\n", defaultCommand.name) //nolint: errcheck
 
-		return nil
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
+	flag.PrintDefaults()
 }
@@ -0,0 +1,223 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	talosnet "github.com/talos-systems/net"
+	clusterctlv1 "sigs.k8s.io/cluster-api/cmd/clusterctl/api/v1alpha3"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/cidr"
+	"github.com/talos-systems/sfyra/pkg/dns"
+	"github.com/talos-systems/sfyra/pkg/registry"
+)
+
+// offlineServices provide local stand-ins for the network services in the offline mode.
+type offlineServices struct {
+	dns      *dns.Server
+	registry *registry.Registry
+	server   *http.Server
+
+	port int
+
+	// bridgeIPs of the enabled networks by the name of the part of the environment
+	bridgeIPs map[string]net.IP
+	// assetsIP is the bridge IP of the bootstrap cluster, Talos boot assets are served to the nodes via it
+	assetsIP net.IP
+}
+
+func bridgeIP(cidrStr string) (net.IP, error) {
+	_, network, err := net.ParseCIDR(cidrStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return talosnet.NthIPInNetwork(network, 1)
+}
+
+// checkOfflineProviders verifies that all the providers are installed from the local manifests.
+//
+// clusterctl fetches components and metadata of other providers (including the core Cluster API provider) from GitHub.
+func checkOfflineProviders(options *Options) error {
+	localProviders, err := parseLocalProviders(*options)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+
+	for _, providers := range []struct {
+		providerType clusterctlv1.ProviderType
+		specs        []string
+	}{
+		{clusterctlv1.CoreProviderType, []string{capi.CoreProviderName}},
+		{clusterctlv1.BootstrapProviderType, append(append([]string(nil), options.BootstrapProviders...), options.UpgradeBootstrapProviders...)},
+		{clusterctlv1.ControlPlaneProviderType, append(append([]string(nil), options.ControlPlaneProviders...), options.UpgradeControlPlaneProviders...)},
+		{clusterctlv1.InfrastructureProviderType, append(append([]string(nil), options.InfrastructureProviders...), options.UpgradeInfrastructureProviders...)},
+	} {
+		for _, spec := range providers.specs {
+			var providerSpec capi.ProviderSpec
+
+			if providerSpec, err = capi.ParseProviderSpec(spec); err != nil {
+				return err
+			}
+
+			if !hasLocalProvider(localProviders, providers.providerType, providerSpec) {
+				missing = append(missing, fmt.Sprintf("%s %s", providers.providerType, providerSpec))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("offline mode requires local manifests for all the providers, missing: %s (use -local-*-provider flags)", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func hasLocalProvider(localProviders []capi.LocalProvider, providerType clusterctlv1.ProviderType, spec capi.ProviderSpec) bool {
+	for _, provider := range localProviders {
+		if provider.Type == providerType && provider.Name == spec.Name && (spec.Version == "" || provider.Version == spec.Version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// startOffline launches DNS responder on the bridge IPs of all the enabled networks, loads images into the local registry
+// and serves the registry and Talos boot assets over HTTP.
+//
+// Kernel and initrd URLs in options are replaced with the local ones unless they were overridden.
+func startOffline(ctx context.Context, options *Options, networks []network) (*offlineServices, error) {
+	if err := checkOfflineProviders(options); err != nil {
+		return nil, err
+	}
+
+	services := &offlineServices{
+		port:      options.OfflineRegistryPort,
+		bridgeIPs: map[string]net.IP{},
+	}
+
+	for _, network := range networks {
+		if !network.enabled {
+			continue
+		}
+
+		if *network.cidr == cidr.Auto {
+			return nil, fmt.Errorf("network of %q is not allocated, as it doesn't exist (use `up` to bring up the environment)", network.name)
+		}
+
+		ip, err := bridgeIP(*network.cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", network.name, err)
+		}
+
+		services.bridgeIPs[network.name] = ip
+	}
+
+	services.assetsIP = services.bridgeIPs[options.BootstrapClusterName]
+
+	services.registry = registry.New()
+
+	var err error
+
+	if err = services.registry.LoadDir(options.OfflineImagesDir); err != nil {
+		return nil, err
+	}
+
+	services.dns = dns.NewServer()
+
+	for _, ip := range services.bridgeIPs {
+		if err = services.dns.Listen(ctx, ip); err != nil {
+			services.dns.Close() //nolint: errcheck
+
+			return nil, fmt.Errorf("error starting DNS responder on %s: %w", ip, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v2/", services.registry)
+	mux.HandleFunc("/assets/vmlinuz", func(w http.ResponseWriter, req *http.Request) {
+		http.ServeFile(w, req, options.BootstrapTalosVmlinuz)
+	})
+	mux.HandleFunc("/assets/initramfs.xz", func(w http.ResponseWriter, req *http.Request) {
+		http.ServeFile(w, req, options.BootstrapTalosInitramfs)
+	})
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(services.port)))
+	if err != nil {
+		services.dns.Close() //nolint: errcheck
+
+		return nil, err
+	}
+
+	services.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := services.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("offline registry server failed: %s", err)
+		}
+	}()
+
+	defaults := DefaultOptions()
+
+	if options.TalosKernelURL == defaults.TalosKernelURL {
+		options.TalosKernelURL = services.assetURL("vmlinuz")
+	}
+
+	if options.TalosInitrdURL == defaults.TalosInitrdURL {
+		options.TalosInitrdURL = services.assetURL("initramfs.xz")
+	}
+
+	log.Printf("offline mode: serving registry mirrors for %v on port %d", services.registry.Hosts(), services.port)
+
+	return services, nil
+}
+
+func (services *offlineServices) assetURL(name string) string {
+	return fmt.Sprintf("http://%s/assets/%s", net.JoinHostPort(services.assetsIP.String(), strconv.Itoa(services.port)), name)
+}
+
+// nameservers returns the local DNS responder address for the nodes in the network of the part of the environment.
+func (services *offlineServices) nameservers(name string) []net.IP {
+	ip, ok := services.bridgeIPs[name]
+	if !ok {
+		return nil
+	}
+
+	return []net.IP{ip}
+}
+
+// registryMirrors returns registry mirror settings pointing to the local registry via the bridge IP
+// of the part of the environment.
+func (services *offlineServices) registryMirrors(name string) []string {
+	ip := services.bridgeIPs[name]
+	hosts := services.registry.Hosts()
+	mirrors := make([]string, len(hosts))
+
+	for i, host := range hosts {
+		mirrors[i] = fmt.Sprintf("%s=http://%s", host, net.JoinHostPort(ip.String(), strconv.Itoa(services.port)))
+	}
+
+	return mirrors
+}
+
+// Close the services.
+func (services *offlineServices) Close() error {
+	if err := services.server.Close(); err != nil {
+		return err
+	}
+
+	return services.dns.Close()
+}
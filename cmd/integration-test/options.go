@@ -4,36 +4,123 @@
 
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
 
 // Options control the sidero testing.
+//
+// YAML keys of the options in the config file match the flag names.
 type Options struct {
-	SkipTeardown bool
+	SkipTeardown          bool `yaml:"skip-teardown"`
+	TeardownOnFailureOnly bool `yaml:"teardown-on-failure-only"`
+	SkipPreflight         bool `yaml:"skip-preflight"`
+
+	WaitForLock time.Duration `yaml:"wait-for-lock"`
+
+	RecreateOnMismatch bool `yaml:"recreate-on-mismatch"`
+
+	ReinstallProviders     bool `yaml:"reinstall-providers"`
+	ReinstallProvidersCRDs bool `yaml:"reinstall-providers-crds"`
+
+	BootstrapClusterName    string `yaml:"bootstrap-cluster-name"`
+	BootstrapTalosVmlinuz   string `yaml:"bootstrap-vmlinuz"`
+	BootstrapTalosInitramfs string `yaml:"bootstrap-initramfs"`
+	BootstrapTalosInstaller string `yaml:"bootstrap-installer"`
+	BootstrapCIDR           string `yaml:"bootstrap-cidr"`
+
+	TalosKernelURL string `yaml:"talos-kernel-url"`
+	TalosInitrdURL string `yaml:"talos-initrd-url"`
+	TalosInstaller string `yaml:"talos-installer"`
+
+	TalosUpgradeInstaller string `yaml:"talos-upgrade-installer"`
+
+	KubernetesVersion        string      `yaml:"kubernetes-version"`
+	KubernetesVersionMatrix  stringSlice `yaml:"kubernetes-version-matrix"`
+	KubernetesUpgradeVersion string      `yaml:"kubernetes-upgrade-version"`
+
+	MultiClusterCount int `yaml:"multi-cluster-count"`
+
+	BootstrapProviders      stringSlice `yaml:"bootstrap-providers"`
+	InfrastructureProviders stringSlice `yaml:"infrastructure-providers"`
+	ControlPlaneProviders   stringSlice `yaml:"control-plane-providers"`
+
+	UpgradeBootstrapProviders      stringSlice `yaml:"upgrade-bootstrap-providers"`
+	UpgradeInfrastructureProviders stringSlice `yaml:"upgrade-infrastructure-providers"`
+	UpgradeControlPlaneProviders   stringSlice `yaml:"upgrade-control-plane-providers"`
+
+	InstallTimeout time.Duration `yaml:"install-timeout"`
+
+	LocalCoreProviders           stringSlice `yaml:"local-core-provider"`
+	LocalBootstrapProviders      stringSlice `yaml:"local-bootstrap-provider"`
+	LocalInfrastructureProviders stringSlice `yaml:"local-infrastructure-provider"`
+	LocalControlPlaneProviders   stringSlice `yaml:"local-control-plane-provider"`
+
+	RegistryMirrors stringSlice `yaml:"registry-mirrors"`
+
+	ManagementCIDR  string `yaml:"management-cidr"`
+	ManagementNodes int    `yaml:"management-nodes"`
+
+	ManagementFirmware string `yaml:"management-firmware"`
+	ManagementUEFICIDR string `yaml:"management-uefi-cidr"`
 
-	BootstrapClusterName    string
-	BootstrapTalosVmlinuz   string
-	BootstrapTalosInitramfs string
-	BootstrapTalosInstaller string
-	BootstrapCIDR           string
+	AcceptanceCIDR  string `yaml:"acceptance-cidr"`
+	AcceptanceNodes int    `yaml:"acceptance-nodes"`
 
-	TalosKernelURL string
-	TalosInitrdURL string
-	TalosInstaller string
+	MemMB  int64 `yaml:"mem-mb"`
+	CPUs   int64 `yaml:"cpus"`
+	DiskGB int64 `yaml:"disk-gb"`
 
-	BootstrapProviders      []string
-	InfrastructureProviders []string
-	ControlPlaneProviders   []string
+	// Profiles override VM resources per part of the environment, they are set only in the config file.
+	Profiles map[string]NodeProfile `yaml:"profiles,omitempty"`
 
-	RegistryMirrors stringSlice
+	TalosctlPath string `yaml:"talosctl-path"`
 
-	ManagementCIDR  string
-	ManagementNodes int
+	Offline             bool   `yaml:"offline"`
+	OfflineImagesDir    string `yaml:"offline-images"`
+	OfflineRegistryPort int    `yaml:"offline-registry-port"`
+}
+
+// NodeProfile is the VM resources of the part of the environment.
+//
+// Zero values default to the mem-mb, cpus and disk-gb options.
+type NodeProfile struct {
+	MemMB  int64 `yaml:"mem-mb,omitempty"`
+	CPUs   int64 `yaml:"cpus,omitempty"`
+	DiskGB int64 `yaml:"disk-gb,omitempty"`
+}
+
+// Node profile names.
+const (
+	BootstrapProfile  = "bootstrap"
+	ManagementProfile = "management"
+	AcceptanceProfile = "acceptance"
+)
+
+// profileNames lists the parts of the environment which accept node profiles.
+var profileNames = []string{BootstrapProfile, ManagementProfile, AcceptanceProfile}
+
+// nodeProfile returns VM resources of the part of the environment.
+func (options *Options) nodeProfile(name string) NodeProfile {
+	profile := options.Profiles[name]
+
+	if profile.MemMB == 0 {
+		profile.MemMB = options.MemMB
+	}
 
-	MemMB  int64
-	CPUs   int64
-	DiskGB int64
+	if profile.CPUs == 0 {
+		profile.CPUs = options.CPUs
+	}
+
+	if profile.DiskGB == 0 {
+		profile.DiskGB = options.DiskGB
+	}
 
-	TalosctlPath string
+	return profile
 }
 
 const defaulTalosRelease = "v0.7.0-alpha.2"
@@ -51,17 +138,29 @@ func DefaultOptions() Options {
 		TalosInitrdURL: fmt.Sprintf("https://github.com/talos-systems/talos/releases/download/%s/initramfs.xz", defaulTalosRelease),
 		TalosInstaller: fmt.Sprintf("docker.io/autonomy/installer:%s", defaulTalosRelease),
 
-		BootstrapProviders:      []string{"talos"},
-		InfrastructureProviders: []string{"sidero"},
-		ControlPlaneProviders:   []string{"talos"},
+		KubernetesVersion: "v1.19.0",
+
+		BootstrapProviders:      stringSlice{"talos"},
+		InfrastructureProviders: stringSlice{"sidero"},
+		ControlPlaneProviders:   stringSlice{"talos"},
+
+		InstallTimeout: capi.DefaultInstallTimeout,
 
 		ManagementCIDR:  "172.25.0.0/24",
 		ManagementNodes: 4,
 
+		ManagementFirmware: string(vm.FirmwareBIOS),
+		ManagementUEFICIDR: "172.27.0.0/24",
+
+		AcceptanceCIDR: "172.26.0.0/24",
+
 		MemMB:  2048,
 		CPUs:   2,
 		DiskGB: 4,
 
 		TalosctlPath: "_out/talosctl-linux-amd64",
+
+		OfflineImagesDir:    "_out/images",
+		OfflineRegistryPort: 5050,
 	}
 }
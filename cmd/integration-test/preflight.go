@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/talos-systems/sfyra/pkg/constants"
+	"github.com/talos-systems/sfyra/pkg/preflight"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+// preflightChecks verifies the host before any VMs are created.
+//
+// All the checks are run and reported at once, error is returned if any of them failed.
+func preflightChecks(ctx context.Context, options *Options) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+
+	talosctlVersion, err := requiredTalosctlVersion(options)
+	if err != nil {
+		return err
+	}
+
+	env := newEnvironment(options, nil)
+
+	var networks []preflight.Network
+
+	for _, network := range env.networks() {
+		if network.enabled {
+			networks = append(networks, preflight.Network{Name: network.name, CIDR: *network.cidr})
+		}
+	}
+
+	diskGB := options.nodeProfile(BootstrapProfile).DiskGB +
+		int64(options.ManagementNodes)*options.nodeProfile(ManagementProfile).DiskGB +
+		int64(options.AcceptanceNodes)*options.nodeProfile(AcceptanceProfile).DiskGB
+
+	report := preflight.Run(ctx, preflight.Options{
+		StateDir: dir,
+
+		CNIBinPath: constants.CNIBinPath,
+
+		Networks: networks,
+
+		BootstrapName: options.BootstrapClusterName,
+		Vmlinuz:       options.BootstrapTalosVmlinuz,
+		Initramfs:     options.BootstrapTalosInitramfs,
+
+		TalosctlPath:    options.TalosctlPath,
+		TalosctlVersion: talosctlVersion,
+
+		MinFreeDiskBytes: uint64(diskGB) * 1024 * 1024 * 1024,
+
+		UEFI: options.ManagementFirmware == string(vm.FirmwareUEFI) || options.ManagementFirmware == string(vm.FirmwareMixed),
+	})
+
+	fmt.Println("preflight checks:")
+
+	if err = report.Print(os.Stdout); err != nil {
+		return err
+	}
+
+	if report.Failed() {
+		return fmt.Errorf("preflight checks failed, nothing was created (use -skip-preflight to skip the checks)")
+	}
+
+	return nil
+}
+
+// requiredTalosctlVersion returns the major.minor version of talosctl compatible with the provisioner.
+//
+// Provisioner version from go.mod takes precedence, tag of the bootstrap installer image is used if the build info
+// is not available.
+func requiredTalosctlVersion(options *Options) (string, error) {
+	if version, ok := preflight.ProvisionerVersion(); ok {
+		return preflight.MinorVersion(version)
+	}
+
+	image := options.BootstrapTalosInstaller
+
+	idx := strings.LastIndex(image, ":")
+	if idx <= strings.LastIndex(image, "/") {
+		return "", fmt.Errorf("failed to determine Talos release of the bootstrap installer %q: image tag is missing", image)
+	}
+
+	return preflight.MinorVersion(image[idx+1:])
+}
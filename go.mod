@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/go-logr/logr v0.2.1-0.20200730175230-ee2de8da5be6 // indirect
+	github.com/google/uuid v1.1.1
 	github.com/stretchr/testify v1.6.1
 	github.com/talos-systems/cluster-api-bootstrap-provider-talos v0.2.0-alpha.3
 	github.com/talos-systems/cluster-api-control-plane-provider-talos v0.1.0-alpha.2
@@ -14,6 +15,7 @@ require (
 	github.com/talos-systems/sidero v0.1.0-alpha.1.0.20200915181156-11a0a80e3d8b
 	github.com/talos-systems/talos v0.7.0-alpha.1.0.20200916165852-41ecb826469a
 	github.com/talos-systems/talos/pkg/machinery v0.0.0-20200916165852-41ecb826469a
+	golang.org/x/net v0.0.0-20200707034311-ab3426394381
 	google.golang.org/grpc v1.29.1
 	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
 	k8s.io/api v0.19.1
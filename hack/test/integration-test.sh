@@ -10,6 +10,8 @@ BOOTSTRAP_INSTALLER="docker.io/autonomy/installer:${TALOS_RELEASE}"
 
 TALOSCTL="${ARTIFACTS}/${TALOS_RELEASE}/talosctl-linux-amd64"
 
+INTEGRATION_TEST_CONFIG="${INTEGRATION_TEST_CONFIG:-hack/test/integration-test.yaml}"
+
 chmod +x "${TALOSCTL}"
 
 function build_registry_mirrors {
@@ -36,9 +38,9 @@ else
 fi
 
 ${PREFIX} "${INTEGRATION_TEST}" \
+    -config "${INTEGRATION_TEST_CONFIG}" \
     -bootstrap-initramfs "${BOOTSTRAP_INITRAMFS}" \
     -bootstrap-vmlinuz "${BOOTSTRAP_VMLINUZ}" \
     -bootstrap-installer "${BOOTSTRAP_INSTALLER}" \
     -talosctl-path "${TALOSCTL}" \
-    ${REGISTRY_MIRROR_FLAGS} \
-    -test.v
+    ${REGISTRY_MIRROR_FLAGS}
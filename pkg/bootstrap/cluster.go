@@ -7,12 +7,14 @@ package bootstrap
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	talosnet "github.com/talos-systems/net"
@@ -30,6 +32,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 
 	"github.com/talos-systems/sfyra/pkg/constants"
+	"github.com/talos-systems/sfyra/pkg/state"
 )
 
 // Cluster sets up initial Talos cluster.
@@ -45,6 +48,9 @@ type Cluster struct {
 
 	stateDir   string
 	configPath string
+
+	// created is set (atomically) once Setup starts creating the cluster, including recreation on mismatch.
+	created int32
 }
 
 // Options for the bootstrap cluster.
@@ -58,10 +64,54 @@ type Options struct {
 	TalosctlPath string
 
 	RegistryMirrors []string
+	// Nameservers override default nameservers (constants.Nameservers) if set.
+	Nameservers []net.IP
 
 	MemMB  int64
 	CPUs   int64
 	DiskGB int64
+
+	// RecreateOnMismatch recreates the existing cluster if it was created with different options.
+	RecreateOnMismatch bool
+}
+
+// savedOptions are the options which can't be changed without recreating the cluster.
+type savedOptions struct {
+	CIDR string `yaml:"cidr"`
+
+	Vmlinuz        string `yaml:"vmlinuz"`
+	Initramfs      string `yaml:"initramfs"`
+	InstallerImage string `yaml:"installerImage"`
+
+	RegistryMirrors []string `yaml:"registryMirrors"`
+	Nameservers     []string `yaml:"nameservers"`
+
+	MemMB  int64 `yaml:"memMB"`
+	CPUs   int64 `yaml:"cpus"`
+	DiskGB int64 `yaml:"diskGB"`
+}
+
+func (cluster *Cluster) savedOptions() savedOptions {
+	nameservers := make([]string, len(cluster.options.Nameservers))
+
+	for i := range cluster.options.Nameservers {
+		nameservers[i] = cluster.options.Nameservers[i].String()
+	}
+
+	return savedOptions{
+		CIDR: cluster.options.CIDR,
+
+		Vmlinuz:        cluster.options.Vmlinuz,
+		Initramfs:      cluster.options.Initramfs,
+		InstallerImage: cluster.options.InstallerImage,
+
+		RegistryMirrors: cluster.options.RegistryMirrors,
+		Nameservers:     nameservers,
+
+		MemMB:  cluster.options.MemMB,
+		CPUs:   cluster.options.CPUs,
+		DiskGB: cluster.options.DiskGB,
+	}
 }
 
 // NewCluster creates new bootstrap Talos cluster.
@@ -81,29 +131,24 @@ func NewCluster(ctx context.Context, options Options) (*Cluster, error) {
 }
 
 // Setup the bootstrap cluster.
+//
+// Existing cluster is reused if found, new one is created otherwise.
 func (cluster *Cluster) Setup(ctx context.Context) error {
-	var err error
-
-	cluster.configPath, err = clientconfig.GetDefaultPath()
-	if err != nil {
-		return err
-	}
-
-	defaultStateDir, err := clientconfig.GetTalosDirectory()
+	err := cluster.initPaths()
 	if err != nil {
 		return err
 	}
 
 	log.Printf("cluster.options = %v", cluster.options)
 
-	cluster.stateDir = filepath.Join(defaultStateDir, "clusters")
-
 	fmt.Printf("bootstrap cluster state directory: %s, name: %s\n", cluster.stateDir, cluster.options.Name)
 
 	if err = cluster.findExisting(ctx); err != nil {
 		fmt.Printf("bootstrap cluster not found: %s, creating new one\n", err)
 
 		err = cluster.create(ctx)
+	} else {
+		err = cluster.verifyExisting(ctx)
 	}
 
 	if err != nil {
@@ -113,13 +158,54 @@ func (cluster *Cluster) Setup(ctx context.Context) error {
 	checkCtx, checkCtxCancel := context.WithTimeout(ctx, 10*time.Minute)
 	defer checkCtxCancel()
 
-	if err = check.Wait(checkCtx, cluster.access, check.DefaultClusterChecks(), check.StderrReporter()); err != nil {
+	if err = cluster.Health(checkCtx); err != nil {
 		return err
 	}
 
 	return cluster.untaint(ctx)
 }
 
+// Verify checks that the cluster found with Reflect was created with the same options.
+func (cluster *Cluster) Verify() error {
+	return state.Verify(cluster.stateDir, cluster.options.Name, cluster.savedOptions())
+}
+
+// Reflect finds the existing bootstrap cluster, it doesn't create a new one.
+func (cluster *Cluster) Reflect(ctx context.Context) error {
+	if err := cluster.initPaths(); err != nil {
+		return err
+	}
+
+	if err := cluster.findExisting(ctx); err != nil {
+		return fmt.Errorf("bootstrap cluster %q not found: %w", cluster.options.Name, err)
+	}
+
+	return nil
+}
+
+// Health waits for the bootstrap cluster to pass the health checks until the context is canceled.
+func (cluster *Cluster) Health(ctx context.Context) error {
+	return check.Wait(ctx, cluster.access, check.DefaultClusterChecks(), check.StderrReporter())
+}
+
+func (cluster *Cluster) initPaths() error {
+	var err error
+
+	cluster.configPath, err = clientconfig.GetDefaultPath()
+	if err != nil {
+		return err
+	}
+
+	defaultStateDir, err := clientconfig.GetTalosDirectory()
+	if err != nil {
+		return err
+	}
+
+	cluster.stateDir = filepath.Join(defaultStateDir, "clusters")
+
+	return nil
+}
+
 func (cluster *Cluster) findExisting(ctx context.Context) error {
 	var err error
 
@@ -135,17 +221,15 @@ func (cluster *Cluster) findExisting(ctx context.Context) error {
 
 	config.Context = cluster.options.Name
 
-	_, cidr, err := net.ParseCIDR(cluster.options.CIDR)
-	if err != nil {
-		return err
-	}
+	// network comes from the provisioner state, so that existing cluster is found even if the CIDR option is not resolved
+	cidr := cluster.cluster.Info().Network.CIDR
 
-	cluster.bridgeIP, err = talosnet.NthIPInNetwork(cidr, 1)
+	cluster.bridgeIP, err = talosnet.NthIPInNetwork(&cidr, 1)
 	if err != nil {
 		return err
 	}
 
-	cluster.masterIP, err = talosnet.NthIPInNetwork(cidr, 2)
+	cluster.masterIP, err = talosnet.NthIPInNetwork(&cidr, 2)
 	if err != nil {
 		return err
 	}
@@ -155,7 +239,39 @@ func (cluster *Cluster) findExisting(ctx context.Context) error {
 	return nil
 }
 
+// verifyExisting checks that the existing cluster was created with the same options.
+//
+// If the options don't match, the cluster is recreated if RecreateOnMismatch is set.
+func (cluster *Cluster) verifyExisting(ctx context.Context) error {
+	err := state.Verify(cluster.stateDir, cluster.options.Name, cluster.savedOptions())
+
+	var mismatch *state.MismatchError
+
+	if !errors.As(err, &mismatch) || !cluster.options.RecreateOnMismatch {
+		return err
+	}
+
+	fmt.Printf("bootstrap cluster %s, recreating\n", err)
+
+	if err = cluster.provisioner.Destroy(ctx, cluster.cluster); err != nil {
+		return err
+	}
+
+	cluster.cluster = nil
+
+	return cluster.create(ctx)
+}
+
+// Created returns true if the cluster was created (or recreated) by Setup rather than reused.
+//
+// Created is safe to call concurrently with Setup.
+func (cluster *Cluster) Created() bool {
+	return atomic.LoadInt32(&cluster.created) == 1
+}
+
 func (cluster *Cluster) create(ctx context.Context) error {
+	atomic.StoreInt32(&cluster.created, 1)
+
 	_, cidr, err := net.ParseCIDR(cluster.options.CIDR)
 	if err != nil {
 		return err
@@ -171,6 +287,11 @@ func (cluster *Cluster) create(ctx context.Context) error {
 		return err
 	}
 
+	nameservers := constants.Nameservers
+	if len(cluster.options.Nameservers) > 0 {
+		nameservers = cluster.options.Nameservers
+	}
+
 	request := provision.ClusterRequest{
 		Name: cluster.options.Name,
 
@@ -179,7 +300,7 @@ func (cluster *Cluster) create(ctx context.Context) error {
 			CIDR:        *cidr,
 			GatewayAddr: cluster.bridgeIP,
 			MTU:         constants.MTU,
-			Nameservers: constants.Nameservers,
+			Nameservers: nameservers,
 			CNI: provision.CNIConfig{
 				BinPath:  constants.CNIBinPath,
 				ConfDir:  constants.CNIConfDir,
@@ -243,6 +364,10 @@ func (cluster *Cluster) create(ctx context.Context) error {
 		return err
 	}
 
+	if err = state.Save(cluster.stateDir, cluster.options.Name, cluster.savedOptions()); err != nil {
+		return err
+	}
+
 	cluster.access = access.NewAdapter(cluster.cluster, provision.WithTalosConfig(configBundle.TalosConfig()))
 
 	c, err := clientconfig.Open(cluster.configPath)
@@ -299,7 +424,23 @@ func (cluster *Cluster) untaint(ctx context.Context) error {
 }
 
 // TearDown the bootstrap cluster.
+//
+// If the cluster wasn't set up (e.g. creation was interrupted), leftovers are looked up in the state directory.
 func (cluster *Cluster) TearDown(ctx context.Context) error {
+	if cluster.cluster == nil {
+		if err := cluster.initPaths(); err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(filepath.Join(cluster.stateDir, cluster.options.Name)); os.IsNotExist(err) {
+			return nil
+		}
+
+		if err := cluster.findExisting(ctx); err != nil {
+			return fmt.Errorf("bootstrap cluster %q state is left in %s: %w", cluster.options.Name, cluster.stateDir, err)
+		}
+	}
+
 	if cluster.cluster != nil {
 		if err := cluster.provisioner.Destroy(ctx, cluster.cluster); err != nil {
 			return err
@@ -7,23 +7,22 @@ package capi
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 
 	cabpt "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
 	cacpt "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
 	sidero "github.com/talos-systems/sidero/app/cluster-api-provider-sidero/api/v1alpha3"
 	metal "github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
-	appsv1 "k8s.io/api/apps/v1"
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/cluster-api/api/v1alpha3"
+	clusterctlv1 "sigs.k8s.io/cluster-api/cmd/clusterctl/api/v1alpha3"
 	"sigs.k8s.io/cluster-api/cmd/clusterctl/client"
+	"sigs.k8s.io/cluster-api/cmd/clusterctl/client/config"
 	runtimeclient "sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/talos-systems/sfyra/pkg/talos"
@@ -35,6 +34,10 @@ type Manager struct {
 
 	cluster talos.Cluster
 
+	// clusterctl config path, empty for the default one
+	configPath string
+	tempDir    string
+
 	kubeconfig    client.Kubeconfig
 	client        client.Client
 	clientset     *kubernetes.Clientset
@@ -42,22 +45,54 @@ type Manager struct {
 }
 
 // Options for the CAPI installer.
+//
+// Providers are specified as `name[:version]`, latest release is installed if the version is omitted.
 type Options struct {
 	BootstrapProviders      []string
 	InfrastructureProviders []string
 	ControlPlaneProviders   []string
+
+	// LocalProviders are installed from the locally built manifests via isolated clusterctl config and repository.
+	LocalProviders []LocalProvider
+
+	// InstallTimeout limits the wait for the providers to become ready, DefaultInstallTimeout if zero.
+	InstallTimeout time.Duration
+
+	// DeploymentPatches are applied to the provider deployments on top of the default Sidero patches.
+	DeploymentPatches []DeploymentPatch
 }
 
 // NewManager creates new Manager object.
-func NewManager(ctx context.Context, cluster talos.Cluster, options Options) (*Manager, error) {
+func NewManager(ctx context.Context, cluster talos.Cluster, options Options) (_ *Manager, err error) {
 	clusterAPI := &Manager{
 		options: options,
 		cluster: cluster,
 	}
 
-	var err error
+	err = validateProviderSpecs(options.BootstrapProviders, options.InfrastructureProviders, options.ControlPlaneProviders)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(options.LocalProviders) > 0 {
+		clusterAPI.tempDir, err = ioutil.TempDir("", "sfyra-clusterctl")
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if err != nil {
+				os.RemoveAll(clusterAPI.tempDir) //nolint: errcheck
+			}
+		}()
 
-	clusterAPI.client, err = client.New("")
+		clusterAPI.configPath, err = writeLocalRepository(clusterAPI.tempDir, options.LocalProviders)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	clusterAPI.client, err = client.New(clusterAPI.configPath)
 	if err != nil {
 		return nil, err
 	}
@@ -97,11 +132,53 @@ func (clusterAPI *Manager) GetKubeconfig(ctx context.Context) (client.Kubeconfig
 	return clusterAPI.kubeconfig, nil
 }
 
+// Close removes temporary files created by the Manager.
+//
+// All the files are removed even if some of them fail to be removed.
+func (clusterAPI *Manager) Close() error {
+	var errs []string
+
+	if clusterAPI.kubeconfig.Path != "" {
+		if err := os.Remove(clusterAPI.kubeconfig.Path); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if clusterAPI.tempDir != "" {
+		if err := os.RemoveAll(clusterAPI.tempDir); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error removing temporary files: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
 // GetManagerClient client returns instance of cluster API client.
 func (clusterAPI *Manager) GetManagerClient() client.Client {
 	return clusterAPI.client
 }
 
+// GetClusterTemplate renders the cluster template with the explicit template variables.
+//
+// Each call uses a separate clusterctl client, so templates for different clusters could be rendered concurrently.
+func (clusterAPI *Manager) GetClusterTemplate(options client.GetClusterTemplateOptions, variables map[string]string) (client.Template, error) {
+	configClient, err := config.New(clusterAPI.configPath, config.InjectReader(newConfigReader(variables)))
+	if err != nil {
+		return nil, err
+	}
+
+	capiClient, err := client.New(clusterAPI.configPath, client.InjectConfig(configClient))
+	if err != nil {
+		return nil, err
+	}
+
+	return capiClient.GetClusterTemplate(options)
+}
+
 // GetMetalClient returns k8s client stuffed with CAPI CRDs.
 func (clusterAPI *Manager) GetMetalClient(ctx context.Context) (runtimeclient.Client, error) {
 	if clusterAPI.runtimeClient != nil {
@@ -135,12 +212,21 @@ func (clusterAPI *Manager) GetMetalClient(ctx context.Context) (runtimeclient.Cl
 		return nil, err
 	}
 
+	if err = clusterctlv1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
 	clusterAPI.runtimeClient, err = runtimeclient.New(config, runtimeclient.Options{Scheme: scheme})
 
 	return clusterAPI.runtimeClient, err
 }
 
 // Install the Manager components and wait for them to be ready.
+//
+// Providers already installed in the cluster are reused if their versions match the requested ones, VersionMismatchError
+// is returned otherwise.
+//
+// Install returns once provider deployments are available with the patches applied, webhooks and Sidero CRDs are served.
 func (clusterAPI *Manager) Install(ctx context.Context) error {
 	kubeconfig, err := clusterAPI.GetKubeconfig(ctx)
 	if err != nil {
@@ -158,120 +244,52 @@ func (clusterAPI *Manager) Install(ctx context.Context) error {
 		LogUsageInstructions:    false,
 	}
 
-	_, err = clusterAPI.clientset.CoreV1().Namespaces().Get(ctx, "sidero-system", metav1.GetOptions{})
-	if err != nil {
-		_, err = clusterAPI.client.Init(options)
-		if err != nil {
-			return err
-		}
-	}
-
-	return clusterAPI.patch(ctx)
-}
-
-func (clusterAPI *Manager) patch(ctx context.Context) error {
-	const (
-		sideroNamespace         = "sidero-system"
-		sideroMetadataServer    = "sidero-metadata-server"
-		sideroControllerManager = "sidero-controller-manager"
-	)
-
-	// sidero-metadata-server
-	deployment, err := clusterAPI.clientset.AppsV1().Deployments(sideroNamespace).Get(ctx, sideroMetadataServer, metav1.GetOptions{})
-	if err != nil {
-		return err
-	}
-
-	oldDeployment, err := json.Marshal(deployment)
+	installed, err := clusterAPI.InstalledProviders(ctx)
 	if err != nil {
 		return err
 	}
 
-	argsPatched := false
-
-	for _, arg := range deployment.Spec.Template.Spec.Containers[0].Args {
-		if arg == "--port=9091" {
-			argsPatched = true
+	if len(installed) == 0 {
+		_, err = clusterAPI.client.Init(options)
+		if err != nil {
+			return err
 		}
+	} else if mismatches := clusterAPI.versionMismatches(installed); len(mismatches) > 0 {
+		return &VersionMismatchError{Mismatches: mismatches}
 	}
 
-	if !argsPatched {
-		deployment.Spec.Template.Spec.Containers[0].Args = append(deployment.Spec.Template.Spec.Containers[0].Args, "--port=9091")
-	}
-
-	deployment.Spec.Template.Spec.Containers[0].Ports = []corev1.ContainerPort{
-		{
-			ContainerPort: 9091,
-			HostPort:      9091,
-			Name:          "http",
-			Protocol:      corev1.ProtocolTCP,
-		},
-	}
-	deployment.Spec.Template.Spec.HostNetwork = true
-	deployment.Spec.Strategy.RollingUpdate = nil
-	deployment.Spec.Strategy.Type = appsv1.RecreateDeploymentStrategyType
-
-	newDeployment, err := json.Marshal(deployment)
-	if err != nil {
+	if err = clusterAPI.patch(ctx); err != nil {
 		return err
 	}
 
-	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldDeployment, newDeployment, appsv1.Deployment{})
-	if err != nil {
-		return fmt.Errorf("failed to create two way merge patch: %w", err)
-	}
+	return clusterAPI.waitReady(ctx)
+}
 
-	_, err = clusterAPI.clientset.AppsV1().Deployments(sideroNamespace).Patch(ctx, deployment.Name, types.StrategicMergePatchType, patchBytes, metav1.PatchOptions{
-		FieldManager: "sfyra",
-	})
+// Verify checks that the providers are installed with the requested versions and ready without changing the cluster.
+func (clusterAPI *Manager) Verify(ctx context.Context) error {
+	installed, err := clusterAPI.InstalledProviders(ctx)
 	if err != nil {
 		return err
 	}
 
-	// sidero-controller-manager
-	deployment, err = clusterAPI.clientset.AppsV1().Deployments(sideroNamespace).Get(ctx, sideroControllerManager, metav1.GetOptions{})
-	if err != nil {
-		return err
+	if len(installed) == 0 {
+		return fmt.Errorf("no providers installed")
 	}
 
-	oldDeployment, err = json.Marshal(deployment)
-	if err != nil {
-		return err
+	if mismatches := clusterAPI.versionMismatches(installed); len(mismatches) > 0 {
+		return &VersionMismatchError{Mismatches: mismatches}
 	}
 
-	argsPatched = false
+	return clusterAPI.CheckReady(ctx)
+}
 
-	for _, arg := range deployment.Spec.Template.Spec.Containers[1].Args {
-		if arg == "--metrics-addr=127.0.0.1:8080" {
-			argsPatched = true
+// patch applies default and user supplied deployment patches.
+func (clusterAPI *Manager) patch(ctx context.Context) error {
+	for _, patch := range mergePatches(defaultPatches(clusterAPI.cluster.SideroComponentsIP().String()), clusterAPI.options.DeploymentPatches) {
+		if err := applyPatch(ctx, clusterAPI.clientset, patch); err != nil {
+			return err
 		}
 	}
 
-	if !argsPatched {
-		deployment.Spec.Template.Spec.Containers[1].Args = append(deployment.Spec.Template.Spec.Containers[1].Args,
-			fmt.Sprintf("--api-endpoint=%s", clusterAPI.cluster.SideroComponentsIP()), "--metrics-addr=127.0.0.1:8080", "--enable-leader-election")
-	}
-
-	deployment.Spec.Template.Spec.HostNetwork = true
-	deployment.Spec.Strategy.RollingUpdate = nil
-	deployment.Spec.Strategy.Type = appsv1.RecreateDeploymentStrategyType
-
-	newDeployment, err = json.Marshal(deployment)
-	if err != nil {
-		return err
-	}
-
-	patchBytes, err = strategicpatch.CreateTwoWayMergePatch(oldDeployment, newDeployment, appsv1.Deployment{})
-	if err != nil {
-		return fmt.Errorf("failed to create two way merge patch: %w", err)
-	}
-
-	_, err = clusterAPI.clientset.AppsV1().Deployments(sideroNamespace).Patch(ctx, deployment.Name, types.StrategicMergePatchType, patchBytes, metav1.PatchOptions{
-		FieldManager: "sfyra",
-	})
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package capi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/cluster-api/cmd/clusterctl/client/config"
+)
+
+// configReader implements clusterctl config.Reader.
+//
+// Values are looked up in the explicit variables first, then in the environment and in the clusterctl config file,
+// so that templates could be rendered without touching the process environment.
+type configReader struct {
+	variables map[string]string
+	config    map[string]interface{}
+}
+
+var _ config.Reader = &configReader{}
+
+func newConfigReader(variables map[string]string) *configReader {
+	reader := &configReader{
+		variables: map[string]string{},
+	}
+
+	for k, v := range variables {
+		reader.variables[k] = v
+	}
+
+	return reader
+}
+
+// Init implements config.Reader.
+func (reader *configReader) Init(path string) error {
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+
+		path = filepath.Join(homeDir, ".cluster-api", "clusterctl.yaml")
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return yaml.Unmarshal(contents, &reader.config)
+}
+
+// Get implements config.Reader.
+func (reader *configReader) Get(key string) (string, error) {
+	if value, ok := reader.variables[key]; ok {
+		return value, nil
+	}
+
+	if value, ok := os.LookupEnv(key); ok {
+		return value, nil
+	}
+
+	if value, ok := reader.config[key]; ok {
+		return fmt.Sprint(value), nil
+	}
+
+	return "", fmt.Errorf("failed to get value for variable %q. Please set the variable value using os env variables or using the clusterctl config file", key)
+}
+
+// Set implements config.Reader.
+func (reader *configReader) Set(key, value string) {
+	reader.variables[key] = value
+}
+
+// UnmarshalKey implements config.Reader.
+func (reader *configReader) UnmarshalKey(key string, rawval interface{}) error {
+	value, ok := reader.config[key]
+	if !ok {
+		return nil
+	}
+
+	// config file is YAML, while clusterctl types are annotated for JSON
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, rawval)
+}
@@ -0,0 +1,366 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package capi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const fieldManager = "sfyra"
+
+// DeploymentPatch describes the changes to the provider deployment.
+type DeploymentPatch struct {
+	Namespace string
+	Name      string
+
+	// HostNetwork is left unchanged if nil.
+	HostNetwork *bool
+	// Strategy is left unchanged if empty.
+	Strategy appsv1.DeploymentStrategyType
+
+	Containers []ContainerPatch
+}
+
+// ContainerPatch describes the changes to the deployment container selected by name.
+type ContainerPatch struct {
+	Name string
+
+	// Args are set as `--key=value` (`--key` for the empty value) replacing existing value for the same key.
+	Args map[string]string
+
+	// Ports are merged with the existing ports by the container port and protocol.
+	Ports []corev1.ContainerPort
+}
+
+func defaultPatches(sideroComponentsIP string) []DeploymentPatch {
+	hostNetwork := true
+
+	return []DeploymentPatch{
+		{
+			Namespace:   "sidero-system",
+			Name:        "sidero-metadata-server",
+			HostNetwork: &hostNetwork,
+			Strategy:    appsv1.RecreateDeploymentStrategyType,
+			Containers: []ContainerPatch{
+				{
+					Name: "server",
+					Args: map[string]string{
+						"port": "9091",
+					},
+					Ports: []corev1.ContainerPort{
+						{
+							ContainerPort: 9091,
+							HostPort:      9091,
+							Name:          "http",
+							Protocol:      corev1.ProtocolTCP,
+						},
+					},
+				},
+			},
+		},
+		{
+			Namespace:   "sidero-system",
+			Name:        "sidero-controller-manager",
+			HostNetwork: &hostNetwork,
+			Strategy:    appsv1.RecreateDeploymentStrategyType,
+			Containers: []ContainerPatch{
+				{
+					Name: "manager",
+					Args: map[string]string{
+						"api-endpoint":           sideroComponentsIP,
+						"metrics-addr":           "127.0.0.1:8080",
+						"enable-leader-election": "",
+					},
+				},
+			},
+		},
+	}
+}
+
+// mergePatches merges extra patches into the base ones, extra patches take precedence.
+func mergePatches(base, extra []DeploymentPatch) []DeploymentPatch {
+	result := make([]DeploymentPatch, 0, len(base)+len(extra))
+
+	for _, patch := range base {
+		patch.Containers = append([]ContainerPatch(nil), patch.Containers...)
+
+		result = append(result, patch)
+	}
+
+	for _, patch := range extra {
+		idx := -1
+
+		for i := range result {
+			if result[i].Namespace == patch.Namespace && result[i].Name == patch.Name {
+				idx = i
+
+				break
+			}
+		}
+
+		if idx == -1 {
+			result = append(result, patch)
+
+			continue
+		}
+
+		if patch.HostNetwork != nil {
+			result[idx].HostNetwork = patch.HostNetwork
+		}
+
+		if patch.Strategy != "" {
+			result[idx].Strategy = patch.Strategy
+		}
+
+		for _, container := range patch.Containers {
+			result[idx].Containers = mergeContainerPatch(result[idx].Containers, container)
+		}
+	}
+
+	return result
+}
+
+func mergeContainerPatch(containers []ContainerPatch, patch ContainerPatch) []ContainerPatch {
+	for i := range containers {
+		if containers[i].Name != patch.Name {
+			continue
+		}
+
+		args := make(map[string]string, len(containers[i].Args)+len(patch.Args))
+
+		for k, v := range containers[i].Args {
+			args[k] = v
+		}
+
+		for k, v := range patch.Args {
+			args[k] = v
+		}
+
+		containers[i].Args = args
+		containers[i].Ports = append(append([]corev1.ContainerPort(nil), containers[i].Ports...), patch.Ports...)
+
+		return containers
+	}
+
+	return append(containers, patch)
+}
+
+// applyPatch applies the patch to the deployment with server-side apply and verifies the result.
+func applyPatch(ctx context.Context, clientset *kubernetes.Clientset, patch DeploymentPatch) error {
+	deployments := clientset.AppsV1().Deployments(patch.Namespace)
+
+	deployment, err := deployments.Get(ctx, patch.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting deployment %s/%s: %w", patch.Namespace, patch.Name, err)
+	}
+
+	// args is an atomic list, so the full list is applied
+	containers := make([]interface{}, 0, len(patch.Containers))
+
+	for _, containerPatch := range patch.Containers {
+		container := findContainer(deployment, containerPatch.Name)
+		if container == nil {
+			return fmt.Errorf("container %q not found in deployment %s/%s", containerPatch.Name, patch.Namespace, patch.Name)
+		}
+
+		spec := map[string]interface{}{
+			"name": containerPatch.Name,
+		}
+
+		if len(containerPatch.Args) > 0 {
+			spec["args"] = mergeArgs(container.Args, containerPatch.Args)
+		}
+
+		if len(containerPatch.Ports) > 0 {
+			spec["ports"] = containerPatch.Ports
+		}
+
+		containers = append(containers, spec)
+	}
+
+	// server-side apply can't drop rollingUpdate owned by another manager, while it's invalid for the Recreate strategy,
+	// so strategy is switched with the strategic merge patch
+	if patch.Strategy != "" && deployment.Spec.Strategy.Type != patch.Strategy {
+		strategyPatch := fmt.Sprintf(`{"spec":{"strategy":{"$retainKeys":["type"],"type":%q}}}`, patch.Strategy)
+
+		_, err = deployments.Patch(ctx, patch.Name, types.StrategicMergePatchType, []byte(strategyPatch), metav1.PatchOptions{
+			FieldManager: fieldManager,
+		})
+		if err != nil {
+			return fmt.Errorf("error patching strategy of deployment %s/%s: %w", patch.Namespace, patch.Name, err)
+		}
+	}
+
+	podSpec := map[string]interface{}{
+		"containers": containers,
+	}
+
+	if patch.HostNetwork != nil {
+		podSpec["hostNetwork"] = *patch.HostNetwork
+	}
+
+	applyConfig := map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"namespace": patch.Namespace,
+			"name":      patch.Name,
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": podSpec,
+			},
+		},
+	}
+
+	data, err := json.Marshal(applyConfig)
+	if err != nil {
+		return err
+	}
+
+	force := true
+
+	deployment, err = deployments.Patch(ctx, patch.Name, types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: fieldManager,
+		Force:        &force,
+	})
+	if err != nil {
+		return fmt.Errorf("error applying patch to deployment %s/%s: %w", patch.Namespace, patch.Name, err)
+	}
+
+	return validatePatch(deployment, patch)
+}
+
+// validatePatch verifies that the deployment matches the patch.
+func validatePatch(deployment *appsv1.Deployment, patch DeploymentPatch) error {
+	var problems []string
+
+	if patch.HostNetwork != nil && deployment.Spec.Template.Spec.HostNetwork != *patch.HostNetwork {
+		problems = append(problems, fmt.Sprintf("hostNetwork is %v", deployment.Spec.Template.Spec.HostNetwork))
+	}
+
+	if patch.Strategy != "" && deployment.Spec.Strategy.Type != patch.Strategy {
+		problems = append(problems, fmt.Sprintf("strategy is %q", deployment.Spec.Strategy.Type))
+	}
+
+	for _, containerPatch := range patch.Containers {
+		container := findContainer(deployment, containerPatch.Name)
+		if container == nil {
+			problems = append(problems, fmt.Sprintf("container %q is missing", containerPatch.Name))
+
+			continue
+		}
+
+		values := map[string][]string{}
+
+		for _, arg := range container.Args {
+			if key, ok := argKey(arg); ok {
+				values[key] = append(values[key], arg)
+			}
+		}
+
+		for key, value := range containerPatch.Args {
+			if expected := formatArg(key, value); len(values[key]) != 1 || values[key][0] != expected {
+				problems = append(problems, fmt.Sprintf("container %q args %v, expected %q", containerPatch.Name, values[key], expected))
+			}
+		}
+
+		for _, port := range containerPatch.Ports {
+			found := false
+
+			for _, existing := range container.Ports {
+				if existing.ContainerPort == port.ContainerPort && existing.HostPort == port.HostPort && existing.Protocol == port.Protocol {
+					found = true
+
+					break
+				}
+			}
+
+			if !found {
+				problems = append(problems, fmt.Sprintf("container %q port %d/%s is missing", containerPatch.Name, port.ContainerPort, port.Protocol))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("deployment %s/%s doesn't match the patch: %s", patch.Namespace, patch.Name, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func findContainer(deployment *appsv1.Deployment, name string) *corev1.Container {
+	for i := range deployment.Spec.Template.Spec.Containers {
+		if deployment.Spec.Template.Spec.Containers[i].Name == name {
+			return &deployment.Spec.Template.Spec.Containers[i]
+		}
+	}
+
+	return nil
+}
+
+// mergeArgs replaces values of the existing args by key, and appends the missing ones in the sorted order.
+func mergeArgs(existing []string, args map[string]string) []string {
+	result := make([]string, 0, len(existing)+len(args))
+	set := map[string]bool{}
+
+	for _, arg := range existing {
+		key, ok := argKey(arg)
+
+		if value, patched := args[key]; ok && patched {
+			if !set[key] {
+				result = append(result, formatArg(key, value))
+				set[key] = true
+			}
+
+			continue
+		}
+
+		result = append(result, arg)
+	}
+
+	keys := make([]string, 0, len(args))
+
+	for key := range args {
+		if !set[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		result = append(result, formatArg(key, args[key]))
+	}
+
+	return result
+}
+
+// argKey returns flag name for the args like `--key=value` or `--key`.
+func argKey(arg string) (string, bool) {
+	if !strings.HasPrefix(arg, "-") {
+		return "", false
+	}
+
+	return strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0], true
+}
+
+func formatArg(key, value string) string {
+	if value == "" {
+		return "--" + key
+	}
+
+	return "--" + key + "=" + value
+}
@@ -0,0 +1,285 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package capi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/talos-systems/go-retry/retry"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterctlv1 "sigs.k8s.io/cluster-api/cmd/clusterctl/api/v1alpha3"
+	"sigs.k8s.io/cluster-api/cmd/clusterctl/client"
+)
+
+// CoreProviderName is the name of the core Cluster API provider installed by clusterctl.
+const CoreProviderName = "cluster-api"
+
+// ProviderSpec is a provider reference in the clusterctl format `name[:version]`.
+type ProviderSpec struct {
+	Name string
+	// Version is empty for the latest release.
+	Version string
+}
+
+// ParseProviderSpec parses provider spec in the form `name[:version]`.
+func ParseProviderSpec(spec string) (ProviderSpec, error) {
+	parts := strings.SplitN(spec, ":", 2)
+
+	provider := ProviderSpec{
+		Name: parts[0],
+	}
+
+	if provider.Name == "" {
+		return provider, fmt.Errorf("provider name is empty: %q", spec)
+	}
+
+	if len(parts) > 1 {
+		provider.Version = parts[1]
+
+		if provider.Version == "" {
+			return provider, fmt.Errorf("provider version is empty: %q", spec)
+		}
+	}
+
+	return provider, nil
+}
+
+// String implements fmt.Stringer.
+func (spec ProviderSpec) String() string {
+	if spec.Version == "" {
+		return spec.Name
+	}
+
+	return spec.Name + ":" + spec.Version
+}
+
+func validateProviderSpecs(specs ...[]string) error {
+	for _, list := range specs {
+		for _, spec := range list {
+			if _, err := ParseProviderSpec(spec); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// UpgradeOptions specify provider versions to upgrade to.
+//
+// Each provider is specified as `name:version`, providers which are not listed are not upgraded.
+type UpgradeOptions struct {
+	BootstrapProviders      []string
+	InfrastructureProviders []string
+	ControlPlaneProviders   []string
+}
+
+// VersionMismatchError is returned when the installed provider versions don't match the requested ones.
+type VersionMismatchError struct {
+	Mismatches []string
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("installed providers don't match the requested versions: %s", strings.Join(e.Mismatches, ", "))
+}
+
+// InstalledProviders returns the list of the providers installed by clusterctl.
+func (clusterAPI *Manager) InstalledProviders(ctx context.Context) ([]clusterctlv1.Provider, error) {
+	metalClient, err := clusterAPI.GetMetalClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers clusterctlv1.ProviderList
+
+	if err = metalClient.List(ctx, &providers); err != nil {
+		// clusterctl inventory CRD is created with the first provider installed
+		if meta.IsNoMatchError(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return providers.Items, nil
+}
+
+// Upgrade the installed providers with `clusterctl upgrade apply`.
+//
+// Sidero deployments are patched again after the upgrade, as the upgrade replaces them.
+func (clusterAPI *Manager) Upgrade(ctx context.Context, options UpgradeOptions) error {
+	kubeconfig, err := clusterAPI.GetKubeconfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	installed, err := clusterAPI.InstalledProviders(ctx)
+	if err != nil {
+		return err
+	}
+
+	upgradeOptions := client.ApplyUpgradeOptions{
+		Kubeconfig: kubeconfig,
+	}
+
+	for _, provider := range installed {
+		if provider.Type == string(clusterctlv1.CoreProviderType) {
+			upgradeOptions.ManagementGroup = provider.Namespace + "/" + provider.ProviderName
+		}
+	}
+
+	if upgradeOptions.ManagementGroup == "" {
+		return fmt.Errorf("core provider is not installed")
+	}
+
+	// clusterctl expects upgrade items in the form `namespace/name:version`
+	for _, item := range []struct {
+		providerType clusterctlv1.ProviderType
+		specs        []string
+		dest         *[]string
+	}{
+		{clusterctlv1.BootstrapProviderType, options.BootstrapProviders, &upgradeOptions.BootstrapProviders},
+		{clusterctlv1.InfrastructureProviderType, options.InfrastructureProviders, &upgradeOptions.InfrastructureProviders},
+		{clusterctlv1.ControlPlaneProviderType, options.ControlPlaneProviders, &upgradeOptions.ControlPlaneProviders},
+	} {
+		for _, s := range item.specs {
+			var (
+				spec     ProviderSpec
+				provider clusterctlv1.Provider
+			)
+
+			if spec, err = ParseProviderSpec(s); err != nil {
+				return err
+			}
+
+			if spec.Version == "" {
+				return fmt.Errorf("provider version to upgrade to is not set: %q", s)
+			}
+
+			if provider, err = findProvider(installed, item.providerType, spec.Name); err != nil {
+				return err
+			}
+
+			*item.dest = append(*item.dest, provider.Namespace+"/"+spec.String())
+		}
+	}
+
+	if err = clusterAPI.client.ApplyUpgrade(upgradeOptions); err != nil {
+		return err
+	}
+
+	if err = clusterAPI.patch(ctx); err != nil {
+		return err
+	}
+
+	return clusterAPI.waitReady(ctx)
+}
+
+// Uninstall deletes all the providers with `clusterctl delete --all` and waits for the provider namespaces to be removed.
+//
+// With includeCRDs provider CRDs are removed as well, which removes all the objects of the provider types (e.g. Servers).
+func (clusterAPI *Manager) Uninstall(ctx context.Context, includeCRDs bool) error {
+	kubeconfig, err := clusterAPI.GetKubeconfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	installed, err := clusterAPI.InstalledProviders(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(installed) == 0 {
+		return nil
+	}
+
+	if err = clusterAPI.client.Delete(client.DeleteOptions{
+		Kubeconfig:       kubeconfig,
+		IncludeNamespace: true,
+		IncludeCRDs:      includeCRDs,
+		DeleteAll:        true,
+	}); err != nil {
+		return err
+	}
+
+	var namespaces []string
+
+	for _, provider := range installed {
+		namespaces = appendUnique(namespaces, provider.Namespace)
+	}
+
+	return retry.Constant(5*time.Minute, retry.WithUnits(5*time.Second)).Retry(func() error {
+		for _, namespace := range namespaces {
+			_, err = clusterAPI.clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+			if err == nil {
+				return retry.ExpectedError(fmt.Errorf("namespace %q is not removed yet", namespace))
+			}
+
+			if !apierrors.IsNotFound(err) {
+				return retry.UnexpectedError(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// versionMismatches compares installed provider versions with the requested ones.
+//
+// Providers requested without the version match any installed version.
+func (clusterAPI *Manager) versionMismatches(installed []clusterctlv1.Provider) []string {
+	var mismatches []string
+
+	for _, item := range []struct {
+		providerType clusterctlv1.ProviderType
+		specs        []string
+	}{
+		{clusterctlv1.BootstrapProviderType, clusterAPI.options.BootstrapProviders},
+		{clusterctlv1.InfrastructureProviderType, clusterAPI.options.InfrastructureProviders},
+		{clusterctlv1.ControlPlaneProviderType, clusterAPI.options.ControlPlaneProviders},
+	} {
+		for _, s := range item.specs {
+			spec, err := ParseProviderSpec(s)
+			if err != nil {
+				// specs are validated in NewManager
+				continue
+			}
+
+			for _, local := range clusterAPI.options.LocalProviders {
+				if spec.Version == "" && local.Type == item.providerType && local.Name == spec.Name {
+					spec.Version = local.Version
+				}
+			}
+
+			provider, err := findProvider(installed, item.providerType, spec.Name)
+			if err != nil {
+				mismatches = append(mismatches, fmt.Sprintf("%s %q is not installed", item.providerType, spec.Name))
+
+				continue
+			}
+
+			if spec.Version != "" && provider.Version != spec.Version {
+				mismatches = append(mismatches, fmt.Sprintf("%s %q is %s, requested %s", item.providerType, spec.Name, provider.Version, spec.Version))
+			}
+		}
+	}
+
+	return mismatches
+}
+
+func findProvider(installed []clusterctlv1.Provider, providerType clusterctlv1.ProviderType, name string) (clusterctlv1.Provider, error) {
+	for _, provider := range installed {
+		if provider.Type == string(providerType) && provider.ProviderName == name {
+			return provider, nil
+		}
+	}
+
+	return clusterctlv1.Provider{}, fmt.Errorf("%s %q is not installed", providerType, name)
+}
@@ -0,0 +1,141 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package capi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	clusterctlv1 "sigs.k8s.io/cluster-api/cmd/clusterctl/api/v1alpha3"
+)
+
+// LocalProvider is a provider installed from the locally built manifests.
+type LocalProvider struct {
+	Type    clusterctlv1.ProviderType
+	Name    string
+	Version string
+
+	ComponentsPath string
+	// MetadataPath defaults to metadata.yaml next to the components.
+	MetadataPath string
+}
+
+// ParseLocalProvider parses local provider spec in the form `name:version=components.yaml[,metadata.yaml]`.
+func ParseLocalProvider(providerType clusterctlv1.ProviderType, spec string) (LocalProvider, error) {
+	provider := LocalProvider{
+		Type: providerType,
+	}
+
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return provider, fmt.Errorf("unexpected local provider format: %q", spec)
+	}
+
+	nameVersion := strings.SplitN(parts[0], ":", 2)
+	if len(nameVersion) != 2 || nameVersion[0] == "" || nameVersion[1] == "" {
+		return provider, fmt.Errorf("local provider should specify name and version: %q", spec)
+	}
+
+	provider.Name, provider.Version = nameVersion[0], nameVersion[1]
+
+	paths := strings.SplitN(parts[1], ",", 2)
+
+	provider.ComponentsPath = paths[0]
+
+	if len(paths) > 1 {
+		provider.MetadataPath = paths[1]
+	} else {
+		provider.MetadataPath = filepath.Join(filepath.Dir(provider.ComponentsPath), "metadata.yaml")
+	}
+
+	return provider, nil
+}
+
+// label returns provider label as clusterctl expects it in the repository path.
+func (provider LocalProvider) label() string {
+	switch provider.Type { //nolint: exhaustive
+	case clusterctlv1.BootstrapProviderType:
+		return "bootstrap-" + provider.Name
+	case clusterctlv1.ControlPlaneProviderType:
+		return "control-plane-" + provider.Name
+	case clusterctlv1.InfrastructureProviderType:
+		return "infrastructure-" + provider.Name
+	default:
+		return provider.Name
+	}
+}
+
+type configProvider struct {
+	Name string                    `yaml:"name"`
+	URL  string                    `yaml:"url"`
+	Type clusterctlv1.ProviderType `yaml:"type"`
+}
+
+// writeLocalRepository builds clusterctl local repository for the providers in the directory.
+//
+// Returns the path to the generated clusterctl config.
+func writeLocalRepository(dir string, providers []LocalProvider) (string, error) {
+	var config struct {
+		Providers []configProvider `yaml:"providers"`
+	}
+
+	for _, provider := range providers {
+		versionDir := filepath.Join(dir, "repository", provider.label(), provider.Version)
+
+		if err := os.MkdirAll(versionDir, 0o755); err != nil {
+			return "", err
+		}
+
+		componentsName := filepath.Base(provider.ComponentsPath)
+
+		if err := copyFile(provider.ComponentsPath, filepath.Join(versionDir, componentsName)); err != nil {
+			return "", err
+		}
+
+		if err := copyFile(provider.MetadataPath, filepath.Join(versionDir, "metadata.yaml")); err != nil {
+			return "", err
+		}
+
+		// cluster templates are picked up from the same directory as the components
+		templates, err := filepath.Glob(filepath.Join(filepath.Dir(provider.ComponentsPath), "cluster-template*.yaml"))
+		if err != nil {
+			return "", err
+		}
+
+		for _, template := range templates {
+			if err = copyFile(template, filepath.Join(versionDir, filepath.Base(template))); err != nil {
+				return "", err
+			}
+		}
+
+		config.Providers = append(config.Providers, configProvider{
+			Name: provider.Name,
+			URL:  "file://" + filepath.Join(versionDir, componentsName),
+			Type: provider.Type,
+		})
+	}
+
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		return "", err
+	}
+
+	configPath := filepath.Join(dir, "clusterctl.yaml")
+
+	return configPath, ioutil.WriteFile(configPath, data, 0o644)
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dst, data, 0o644)
+}
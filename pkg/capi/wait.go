@@ -0,0 +1,245 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package capi
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/talos-systems/go-retry/retry"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultInstallTimeout is the default timeout for the providers to become ready.
+const DefaultInstallTimeout = 10 * time.Minute
+
+// capi webhooks are installed into the shared namespace which is not recorded in the provider inventory.
+const capiWebhookNamespace = "capi-webhook-system"
+
+// sideroResources should be served once Sidero CRDs are established.
+var sideroResources = map[string][]string{
+	"metal.sidero.dev/v1alpha1":                {"servers", "serverclasses", "environments"},
+	"infrastructure.cluster.x-k8s.io/v1alpha3": {"metalclusters", "metalmachines", "metalmachinetemplates"},
+}
+
+// waitReady waits for the provider deployments to be available, webhooks and CRDs to be served.
+func (clusterAPI *Manager) waitReady(ctx context.Context) error {
+	timeout := clusterAPI.options.InstallTimeout
+	if timeout == 0 {
+		timeout = DefaultInstallTimeout
+	}
+
+	var lastErr error
+
+	err := retry.Constant(timeout, retry.WithUnits(5*time.Second)).Retry(func() error {
+		if lastErr = clusterAPI.CheckReady(ctx); lastErr != nil {
+			return retry.ExpectedError(lastErr)
+		}
+
+		return nil
+	})
+	if err != nil {
+		if lastErr != nil {
+			return fmt.Errorf("providers are not ready after %s: %w", timeout, lastErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// CheckReady verifies once that the provider deployments are available, webhooks and CRDs are served.
+func (clusterAPI *Manager) CheckReady(ctx context.Context) error {
+	installed, err := clusterAPI.InstalledProviders(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(installed) == 0 {
+		return fmt.Errorf("no providers installed")
+	}
+
+	namespaces := []string{capiWebhookNamespace}
+
+	for _, provider := range installed {
+		namespaces = appendUnique(namespaces, provider.Namespace)
+	}
+
+	for _, check := range []func(context.Context, []string) error{
+		clusterAPI.checkDeployments,
+		clusterAPI.checkWebhooks,
+		clusterAPI.checkResources,
+	} {
+		if err = check(ctx, namespaces); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkDeployments verifies that each deployment rolled out the latest generation and is available.
+func (clusterAPI *Manager) checkDeployments(ctx context.Context, namespaces []string) error {
+	for _, namespace := range namespaces {
+		deployments, err := clusterAPI.clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+
+		for i := range deployments.Items {
+			deployment := &deployments.Items[i]
+
+			if err = deploymentAvailable(deployment); err != nil {
+				return fmt.Errorf("deployment %s/%s is not available: %w", deployment.Namespace, deployment.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func deploymentAvailable(deployment *appsv1.Deployment) error {
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return fmt.Errorf("generation %d is not observed yet", deployment.Generation)
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	if deployment.Status.UpdatedReplicas != replicas {
+		return fmt.Errorf("%d out of %d replicas updated", deployment.Status.UpdatedReplicas, replicas)
+	}
+
+	if deployment.Status.Replicas != deployment.Status.UpdatedReplicas {
+		return fmt.Errorf("%d old replicas are still running", deployment.Status.Replicas-deployment.Status.UpdatedReplicas)
+	}
+
+	if deployment.Status.AvailableReplicas != replicas {
+		return fmt.Errorf("%d out of %d replicas available", deployment.Status.AvailableReplicas, replicas)
+	}
+
+	for _, cond := range deployment.Status.Conditions {
+		if cond.Type == appsv1.DeploymentAvailable && cond.Status == corev1.ConditionTrue {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("condition %q is not true", appsv1.DeploymentAvailable)
+}
+
+// checkWebhooks verifies that webhooks served from the provider namespaces have ready endpoints.
+func (clusterAPI *Manager) checkWebhooks(ctx context.Context, namespaces []string) error {
+	type service struct {
+		namespace, name, webhook string
+	}
+
+	var services []service
+
+	validating, err := clusterAPI.clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, config := range validating.Items {
+		for _, webhook := range config.Webhooks {
+			if webhook.ClientConfig.Service != nil {
+				services = append(services, service{webhook.ClientConfig.Service.Namespace, webhook.ClientConfig.Service.Name, webhook.Name})
+			}
+		}
+	}
+
+	mutating, err := clusterAPI.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, config := range mutating.Items {
+		for _, webhook := range config.Webhooks {
+			if webhook.ClientConfig.Service != nil {
+				services = append(services, service{webhook.ClientConfig.Service.Namespace, webhook.ClientConfig.Service.Name, webhook.Name})
+			}
+		}
+	}
+
+	for _, svc := range services {
+		if !contains(namespaces, svc.namespace) {
+			continue
+		}
+
+		var endpoints *corev1.Endpoints
+
+		endpoints, err = clusterAPI.clientset.CoreV1().Endpoints(svc.namespace).Get(ctx, svc.name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return fmt.Errorf("webhook %q service %s/%s has no endpoints", svc.webhook, svc.namespace, svc.name)
+			}
+
+			return err
+		}
+
+		ready := false
+
+		for _, subset := range endpoints.Subsets {
+			if len(subset.Addresses) > 0 {
+				ready = true
+			}
+		}
+
+		if !ready {
+			return fmt.Errorf("webhook %q service %s/%s has no ready endpoints", svc.webhook, svc.namespace, svc.name)
+		}
+	}
+
+	return nil
+}
+
+// checkResources verifies that Sidero CRDs are served by the API server.
+func (clusterAPI *Manager) checkResources(ctx context.Context, _ []string) error {
+	for groupVersion, expected := range sideroResources {
+		resources, err := clusterAPI.clientset.Discovery().ServerResourcesForGroupVersion(groupVersion)
+		if err != nil {
+			return fmt.Errorf("error discovering %s resources: %w", groupVersion, err)
+		}
+
+		served := make([]string, 0, len(resources.APIResources))
+
+		for _, resource := range resources.APIResources {
+			served = append(served, resource.Name)
+		}
+
+		for _, name := range expected {
+			if !contains(served, name) {
+				return fmt.Errorf("resource %s is not served in %s", name, groupVersion)
+			}
+		}
+	}
+
+	return nil
+}
+
+func contains(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func appendUnique(slice []string, s string) []string {
+	if contains(slice, s) {
+		return slice
+	}
+
+	return append(slice, s)
+}
@@ -0,0 +1,147 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package cidr allocates networks for the environments which don't overlap networks in use on the host.
+package cidr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/talos-systems/sfyra/pkg/state"
+)
+
+// Auto is the CIDR value which requests automatic allocation.
+const Auto = "auto"
+
+// Pool is the range networks are allocated from.
+var Pool = &net.IPNet{
+	IP:   net.IPv4(172, 24, 0, 0).To4(),
+	Mask: net.CIDRMask(13, 32),
+}
+
+// PrefixLength of the allocated networks.
+const PrefixLength = 24
+
+// Overlaps returns true if two networks have common addresses.
+func Overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// savedCIDR is the part of the options saved for each bootstrap cluster and VM set.
+type savedCIDR struct {
+	CIDR string `yaml:"cidr"`
+}
+
+// Saved returns the CIDR the environment was created with, empty string is returned if it wasn't recorded.
+func Saved(stateDir, name string) (string, error) {
+	var saved savedCIDR
+
+	if err := state.Load(stateDir, name, &saved); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return saved.CIDR, nil
+}
+
+// Used returns the networks in use on the host: host routes, interface addresses
+// networks of the environments saved in the state directory (even if they are not running)
+// and networks reserved for the environments being created.
+func Used(stateDir string) ([]*net.IPNet, error) {
+	routes, err := Routes()
+	if err != nil {
+		return nil, err
+	}
+
+	used := make([]*net.IPNet, 0, len(routes))
+
+	for _, route := range routes {
+		used = append(used, route.Network)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			used = append(used, ipNet)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(stateDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if _, err = os.Stat(filepath.Join(stateDir, entry.Name(), state.FileName)); err != nil {
+			continue
+		}
+
+		var saved string
+
+		if saved, err = Saved(stateDir, entry.Name()); err != nil {
+			return nil, err
+		}
+
+		var network *net.IPNet
+
+		if _, network, err = net.ParseCIDR(saved); err == nil {
+			used = append(used, network)
+		}
+	}
+
+	reservedNetworks, err := reserved(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(used, reservedNetworks...), nil
+}
+
+// Allocate returns the first network in the pool which doesn't overlap any of the used networks.
+func Allocate(pool *net.IPNet, used []*net.IPNet) (*net.IPNet, error) {
+	poolSize, _ := pool.Mask.Size()
+	start := binary.BigEndian.Uint32(pool.IP.To4())
+
+	for i := uint32(0); i < 1<<(PrefixLength-poolSize); i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, start+i<<(32-PrefixLength))
+
+		candidate := &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(PrefixLength, 32),
+		}
+
+		free := true
+
+		for _, network := range used {
+			if Overlaps(candidate, network) {
+				free = false
+
+				break
+			}
+		}
+
+		if free {
+			return candidate, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free /%d networks left in %s", PrefixLength, pool)
+}
@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cidr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/talos-systems/sfyra/pkg/lock"
+)
+
+// reservation records the network allocated for the part of the environment which is not created yet.
+type reservation struct {
+	CIDR string `json:"cidr"`
+	// Environment is the name of the environment lock held while the part is created.
+	Environment string `json:"environment"`
+}
+
+const reservationExt = ".cidr"
+
+// ReservationsDir returns the directory of the reservations and the allocation lock.
+//
+// Directory is separate from the environment locks and the provisioner state, so that names never collide.
+func ReservationsDir(stateDir string) string {
+	return filepath.Join(stateDir, ".sfyra-cidr")
+}
+
+func reservationPath(stateDir, name string) string {
+	return filepath.Join(ReservationsDir(stateDir), name+reservationExt)
+}
+
+// Reserve records the network allocated for the part of the environment, so that concurrent allocations skip it.
+//
+// Reservation is valid while the environment lock is held: by the time the lock is released,
+// the part is either created (and its network is recorded in the saved state) or it doesn't exist.
+func Reserve(stateDir, name, environment string, network *net.IPNet) error {
+	if err := os.MkdirAll(ReservationsDir(stateDir), 0o755); err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(reservation{
+		CIDR:        network.String(),
+		Environment: environment,
+	})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(reservationPath(stateDir, name), contents, 0o644)
+}
+
+// Release removes the reservation of the part of the environment (if any).
+func Release(stateDir, name string) error {
+	if err := os.Remove(reservationPath(stateDir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// reserved returns the networks reserved under the held environment locks.
+func reserved(stateDir string) ([]*net.IPNet, error) {
+	paths, err := filepath.Glob(filepath.Join(ReservationsDir(stateDir), "*"+reservationExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []*net.IPNet
+
+	for _, path := range paths {
+		var contents []byte
+
+		if contents, err = ioutil.ReadFile(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		var r reservation
+
+		if err = json.Unmarshal(contents, &r); err != nil {
+			// unreadable reservation is left by the process which died while writing it
+			continue
+		}
+
+		var owner *lock.Owner
+
+		if owner, err = lock.Holder(stateDir, r.Environment); err != nil {
+			return nil, err
+		}
+
+		if owner == nil {
+			// stale reservation, environment lock was released without removing it
+			continue
+		}
+
+		var network *net.IPNet
+
+		if _, network, err = net.ParseCIDR(r.CIDR); err == nil {
+			networks = append(networks, network)
+		}
+	}
+
+	return networks, nil
+}
@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package cidr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Route is the IPv4 route of the host.
+type Route struct {
+	Interface string
+	Network   *net.IPNet
+}
+
+// Routes returns the IPv4 routes of the host, default routes are skipped.
+func Routes() ([]Route, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint: errcheck
+
+	var routes []Route
+
+	scanner := bufio.NewScanner(f)
+
+	// skip the header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+
+		var destination, mask net.IP
+
+		if destination, err = parseHexIP(fields[1]); err != nil {
+			return nil, err
+		}
+
+		if mask, err = parseHexIP(fields[7]); err != nil {
+			return nil, err
+		}
+
+		network := &net.IPNet{
+			IP:   destination,
+			Mask: net.IPMask(mask),
+		}
+
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			continue
+		}
+
+		routes = append(routes, Route{
+			Interface: fields[0],
+			Network:   network,
+		})
+	}
+
+	return routes, scanner.Err()
+}
+
+// parseHexIP parses IPv4 address in the /proc/net/route format (hex in host byte order).
+func parseHexIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) != net.IPv4len {
+		return nil, fmt.Errorf("unexpected address %q", s)
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+
+	return ip, nil
+}
@@ -0,0 +1,153 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package dns provides minimal local DNS responder for the offline mode.
+package dns
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Server is a local DNS responder.
+//
+// Server responds with NXDOMAIN to any query, so that nodes without outbound
+// network access fail name resolution fast instead of waiting for upstream timeouts.
+type Server struct {
+	mu    sync.Mutex
+	conns []net.PacketConn
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	wg sync.WaitGroup
+}
+
+// NewServer initializes new DNS responder.
+func NewServer() *Server {
+	server := &Server{}
+
+	server.ctx, server.ctxCancel = context.WithCancel(context.Background())
+
+	return server
+}
+
+// Listen starts serving DNS on the address.
+//
+// Address might not exist yet (e.g. bridge IP before the bridge is created).
+func (server *Server) Listen(ctx context.Context, address net.IP) error {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+
+			if err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+			}); err != nil {
+				return err
+			}
+
+			return sockErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(ctx, "udp4", net.JoinHostPort(address.String(), "53"))
+	if err != nil {
+		return err
+	}
+
+	server.mu.Lock()
+	server.conns = append(server.conns, conn)
+	server.mu.Unlock()
+
+	server.wg.Add(1)
+
+	go server.serve(conn)
+
+	return nil
+}
+
+// Close stops the server.
+func (server *Server) Close() error {
+	server.ctxCancel()
+
+	server.mu.Lock()
+
+	for _, conn := range server.conns {
+		conn.Close() //nolint: errcheck
+	}
+
+	server.conns = nil
+
+	server.mu.Unlock()
+
+	server.wg.Wait()
+
+	return nil
+}
+
+func (server *Server) serve(conn net.PacketConn) {
+	defer server.wg.Done()
+
+	buf := make([]byte, 512)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-server.ctx.Done():
+			default:
+				log.Printf("dns read failed: %s", err)
+			}
+
+			return
+		}
+
+		resp, err := server.handle(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if _, err = conn.WriteTo(resp, addr); err != nil {
+			log.Printf("dns write failed: %s", err)
+		}
+	}
+}
+
+func (server *Server) handle(req []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(req)
+	if err != nil {
+		return nil, err
+	}
+
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeNameError,
+	})
+	builder.EnableCompression()
+
+	if err = builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	if err = builder.Question(question); err != nil {
+		return nil, err
+	}
+
+	return builder.Finish()
+}
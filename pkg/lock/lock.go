@@ -0,0 +1,206 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package lock provides advisory locks which prevent concurrent runs against the same environment.
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Owner is the process holding the lock.
+type Owner struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+func (owner Owner) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", owner.PID, owner.Host, owner.Started.Format(time.RFC3339))
+}
+
+// InUseError is returned if the lock is held by another process.
+type InUseError struct {
+	Name  string
+	Owner *Owner
+}
+
+func (e *InUseError) Error() string {
+	if e.Owner == nil {
+		return fmt.Sprintf("environment %q is in use", e.Name)
+	}
+
+	return fmt.Sprintf("environment %q is in use by %s", e.Name, e.Owner)
+}
+
+// Lock is the advisory lock of the environment.
+//
+// Lock is held with flock(2), so it is released automatically if the owner process dies.
+type Lock struct {
+	f *os.File
+}
+
+// Path returns the path to the lock file of the environment.
+func Path(dir, name string) string {
+	return filepath.Join(dir, name+".lock")
+}
+
+// Acquire the lock of the environment in the directory.
+//
+// If the lock is held by another process, Acquire waits for the lock to be released up to wait duration,
+// and returns InUseError afterwards.
+func Acquire(ctx context.Context, dir, name string, wait time.Duration) (*Lock, error) {
+	deadline := time.Now().Add(wait)
+
+	for {
+		lock, err := tryAcquire(dir, name)
+		if err == nil {
+			return lock, nil
+		}
+
+		var inUse *InUseError
+
+		if !errors.As(err, &inUse) || time.Now().After(deadline) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func tryAcquire(dir, name string) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(Path(dir, name), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close() //nolint: errcheck
+
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			owner, _ := readOwner(dir, name) //nolint: errcheck
+
+			return nil, &InUseError{Name: name, Owner: owner}
+		}
+
+		return nil, fmt.Errorf("error locking environment %q: %w", name, err)
+	}
+
+	lock := &Lock{f: f}
+
+	if err = lock.writeOwner(); err != nil {
+		lock.Release() //nolint: errcheck
+
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+func (lock *Lock) writeOwner() error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(Owner{
+		PID:     os.Getpid(),
+		Host:    host,
+		Started: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = lock.f.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err = lock.f.WriteAt(contents, 0)
+
+	return err
+}
+
+// Release the lock.
+//
+// Lock file is kept, as removing it would race with other processes waiting for the lock.
+func (lock *Lock) Release() error {
+	if err := lock.f.Truncate(0); err != nil {
+		lock.f.Close() //nolint: errcheck
+
+		return err
+	}
+
+	return lock.f.Close()
+}
+
+// Holder returns the owner of the lock, nil is returned if the lock is free.
+func Holder(dir, name string) (*Owner, error) {
+	f, err := os.Open(Path(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer f.Close() //nolint: errcheck
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		// lock is free, contents (if any) are left by the process which died
+		return nil, nil
+	}
+
+	if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, err
+	}
+
+	owner, err := readOwner(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner == nil {
+		// owner is not recorded yet
+		owner = &Owner{}
+	}
+
+	return owner, nil
+}
+
+func readOwner(dir, name string) (*Owner, error) {
+	contents, err := ioutil.ReadFile(Path(dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(contents) == 0 {
+		return nil, nil
+	}
+
+	var owner Owner
+
+	if err = json.Unmarshal(contents, &owner); err != nil {
+		return nil, err
+	}
+
+	return &owner, nil
+}
@@ -0,0 +1,50 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FreeDiskBytes returns the free space available to the user on the filesystem of the path.
+//
+// If the path doesn't exist yet, the closest existing parent directory is used.
+func FreeDiskBytes(path string) (uint64, error) {
+	for {
+		var stat syscall.Statfs_t
+
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			return stat.Bavail * uint64(stat.Bsize), nil
+		}
+
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, fmt.Errorf("error checking free space in %q: %w", path, err)
+		}
+
+		path = parent
+	}
+}
+
+func checkDiskSpace(ctx context.Context, options *Options) (string, error) {
+	free, err := FreeDiskBytes(options.StateDir)
+	if err != nil {
+		return "", err
+	}
+
+	const gib = 1024 * 1024 * 1024
+
+	if free < options.MinFreeDiskBytes {
+		return "", fmt.Errorf("%.1f GiB free in %s, while %.1f GiB is required: free up disk space or use less nodes or smaller disks",
+			float64(free)/gib, options.StateDir, float64(options.MinFreeDiskBytes)/gib)
+	}
+
+	return fmt.Sprintf("%.1f GiB free in %s", float64(free)/gib, options.StateDir), nil
+}
@@ -0,0 +1,79 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/talos-systems/sfyra/pkg/cidr"
+)
+
+func checkNetworks(ctx context.Context, options *Options) (string, error) {
+	// `auto` networks are allocated when the environment is created, so they never overlap
+	var (
+		configured []Network
+		auto       int
+	)
+
+	for _, network := range options.Networks {
+		if network.CIDR == cidr.Auto {
+			auto++
+
+			continue
+		}
+
+		configured = append(configured, network)
+	}
+
+	networks := make([]*net.IPNet, len(configured))
+
+	for i, network := range configured {
+		var err error
+
+		if _, networks[i], err = net.ParseCIDR(network.CIDR); err != nil {
+			return "", fmt.Errorf("%s: %w", network.Name, err)
+		}
+
+		for j := 0; j < i; j++ {
+			if cidr.Overlaps(networks[i], networks[j]) {
+				return "", fmt.Errorf("%s CIDR %s overlaps %s CIDR %s: use different CIDRs",
+					network.Name, network.CIDR, configured[j].Name, configured[j].CIDR)
+			}
+		}
+	}
+
+	routes, err := cidr.Routes()
+	if err != nil {
+		return "", err
+	}
+
+	var problems []string
+
+	for i, network := range configured {
+		// bridge of the existing environment is reused
+		if options.exists(network.Name) {
+			continue
+		}
+
+		for _, route := range routes {
+			if cidr.Overlaps(networks[i], route.Network) {
+				problems = append(problems, fmt.Sprintf("%s CIDR %s overlaps route %s dev %s", network.Name, network.CIDR, route.Network, route.Interface))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return "", fmt.Errorf("%s: use different CIDRs or destroy the environments using them", strings.Join(problems, "; "))
+	}
+
+	if auto > 0 {
+		return fmt.Sprintf("%d networks don't overlap host routes, %d networks are allocated on creation", len(networks), auto), nil
+	}
+
+	return fmt.Sprintf("%d networks don't overlap host routes", len(networks)), nil
+}
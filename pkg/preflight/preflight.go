@@ -0,0 +1,196 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package preflight verifies that the host is ready to run the environment before anything is created.
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// Network is the network of the cluster or VM set to be created.
+type Network struct {
+	Name string
+	CIDR string
+}
+
+// Options for the preflight checks.
+type Options struct {
+	// StateDir is the directory of the qemu provisioner state.
+	StateDir string
+
+	// CNIBinPath is the list of directories to look for CNI plugins in.
+	CNIBinPath []string
+
+	// Networks are checked to overlap neither each other nor the host routes.
+	Networks []Network
+
+	// Vmlinuz and Initramfs are required if the bootstrap cluster is going to be created.
+	BootstrapName      string
+	Vmlinuz, Initramfs string
+
+	// TalosctlPath is verified to match TalosctlVersion (major.minor, e.g. v0.7).
+	TalosctlPath    string
+	TalosctlVersion string
+
+	// MinFreeDiskBytes is the free space required in the state directory.
+	MinFreeDiskBytes uint64
+
+	// UEFI is set if any VMs boot with UEFI, OVMF firmware is required.
+	UEFI bool
+}
+
+// RequiredCNIPlugins are used by the qemu provisioner.
+var RequiredCNIPlugins = []string{"bridge", "firewall", "static", "tc-redirect-tap"}
+
+// Result of a single check.
+type Result struct {
+	Check   string
+	Message string
+	Failed  bool
+}
+
+// Report is the list of the results of all the checks.
+type Report []Result
+
+// Failed returns true if any of the checks failed.
+func (report Report) Failed() bool {
+	for _, result := range report {
+		if result.Failed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Print the report as a table.
+func (report Report) Print(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+
+	for _, result := range report {
+		status := "OK"
+		if result.Failed {
+			status = "FAIL"
+		}
+
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", result.Check, status, result.Message); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+type check struct {
+	name string
+	run  func(ctx context.Context, options *Options) (string, error)
+}
+
+var checks = []check{
+	{"root", checkRoot},
+	{"kvm", checkKVM},
+	{"cni plugins", checkCNIPlugins},
+	{"networks", checkNetworks},
+	{"bootstrap kernel", checkBootstrapAssets},
+	{"talosctl", checkTalosctl},
+	{"uefi firmware", checkUEFIFirmware},
+	{"disk space", checkDiskSpace},
+}
+
+// Run all the checks.
+//
+// Checks are independent, so all of them are run to build the complete report.
+func Run(ctx context.Context, options Options) Report {
+	report := make(Report, 0, len(checks))
+
+	for _, c := range checks {
+		message, err := c.run(ctx, &options)
+
+		result := Result{
+			Check:   c.name,
+			Message: message,
+		}
+
+		if err != nil {
+			result.Failed = true
+			result.Message = err.Error()
+		}
+
+		report = append(report, result)
+	}
+
+	return report
+}
+
+// exists checks whether environment with the specified name was created before.
+func (options *Options) exists(name string) bool {
+	_, err := os.Stat(filepath.Join(options.StateDir, name))
+
+	return err == nil
+}
+
+func checkRoot(ctx context.Context, options *Options) (string, error) {
+	if os.Geteuid() != 0 {
+		return "", fmt.Errorf("qemu provisioner requires root, run with `sudo -E`")
+	}
+
+	return "running as root", nil
+}
+
+func checkKVM(ctx context.Context, options *Options) (string, error) {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("%w: enable virtualization in BIOS and load kvm module (`modprobe kvm_intel` or `modprobe kvm_amd`)", err)
+	}
+
+	return "/dev/kvm is accessible", f.Close()
+}
+
+func checkCNIPlugins(ctx context.Context, options *Options) (string, error) {
+	var missing []string
+
+	for _, plugin := range RequiredCNIPlugins {
+		found := false
+
+		for _, dir := range options.CNIBinPath {
+			if st, err := os.Stat(filepath.Join(dir, plugin)); err == nil && st.Mode()&0o111 != 0 {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, plugin)
+		}
+	}
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("plugins %s are missing in %s: install containernetworking plugins and tc-redirect-tap",
+			strings.Join(missing, ", "), strings.Join(options.CNIBinPath, ":"))
+	}
+
+	return fmt.Sprintf("found %s", strings.Join(RequiredCNIPlugins, ", ")), nil
+}
+
+func checkBootstrapAssets(ctx context.Context, options *Options) (string, error) {
+	if options.exists(options.BootstrapName) {
+		return fmt.Sprintf("skipped, bootstrap cluster %q already exists", options.BootstrapName), nil
+	}
+
+	for _, path := range []string{options.Vmlinuz, options.Initramfs} {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("%w: download Talos release assets or build them with `make kernel initramfs` in Talos", err)
+		}
+	}
+
+	return fmt.Sprintf("found %s, %s", options.Vmlinuz, options.Initramfs), nil
+}
@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package preflight
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"runtime/debug"
+	"strings"
+)
+
+// provisionerModule is the Go module of the Talos qemu provisioner.
+const provisionerModule = "github.com/talos-systems/talos"
+
+var minorVersionRe = regexp.MustCompile(`^v?(\d+)\.(\d+)`)
+
+// MinorVersion returns major.minor part of the version, e.g. v0.7 for v0.7.0-alpha.2.
+func MinorVersion(version string) (string, error) {
+	matches := minorVersionRe.FindStringSubmatch(version)
+	if matches == nil {
+		return "", fmt.Errorf("failed to parse version %q", version)
+	}
+
+	return fmt.Sprintf("v%s.%s", matches[1], matches[2]), nil
+}
+
+// ProvisionerVersion returns the version of the Talos qemu provisioner linked into the binary (as required in go.mod).
+//
+// Provisioner runs talosctl as the launcher of the VMs, so talosctl version should match the provisioner version.
+// False is returned if the binary has no module build info or the module is replaced with a local directory.
+func ProvisionerVersion() (string, bool) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", false
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Path != provisionerModule {
+			continue
+		}
+
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+
+		return dep.Version, dep.Version != ""
+	}
+
+	return "", false
+}
+
+// TalosctlVersion returns the tag of talosctl binary.
+func TalosctlVersion(ctx context.Context, talosctlPath string) (string, error) {
+	out, err := exec.CommandContext(ctx, talosctlPath, "version", "--client").Output()
+	if err != nil {
+		return "", fmt.Errorf("error running %q: %w", talosctlPath, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "Tag:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Tag:")), nil
+		}
+	}
+
+	return "", fmt.Errorf("tag not found in %q version output", talosctlPath)
+}
+
+func checkTalosctl(ctx context.Context, options *Options) (string, error) {
+	tag, err := TalosctlVersion(ctx, options.TalosctlPath)
+	if err != nil {
+		return "", fmt.Errorf("%w: download talosctl or set -talosctl-path", err)
+	}
+
+	version, err := MinorVersion(tag)
+	if err != nil {
+		return "", err
+	}
+
+	if version != options.TalosctlVersion {
+		return "", fmt.Errorf("talosctl %s is %s, while %s is required: download talosctl %s.x release", options.TalosctlPath, tag, options.TalosctlVersion, options.TalosctlVersion)
+	}
+
+	return fmt.Sprintf("%s is %s", options.TalosctlPath, tag), nil
+}
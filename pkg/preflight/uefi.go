@@ -0,0 +1,33 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// OVMFPaths are the locations of the OVMF firmware installed by the distro packages.
+var OVMFPaths = []string{
+	"/usr/share/ovmf/OVMF.fd",
+	"/usr/share/OVMF/OVMF.fd",
+	"/usr/share/qemu/OVMF.fd",
+}
+
+func checkUEFIFirmware(ctx context.Context, options *Options) (string, error) {
+	if !options.UEFI {
+		return "skipped, no UEFI VMs", nil
+	}
+
+	for _, path := range OVMFPaths {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Sprintf("found %s", path), nil
+		}
+	}
+
+	return "", fmt.Errorf("OVMF firmware is missing in %s: install ovmf package", strings.Join(OVMFPaths, ", "))
+}
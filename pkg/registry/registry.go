@@ -0,0 +1,347 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package registry provides read-only local OCI registry for the offline mode.
+package registry
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OCI media types used by the registry.
+const (
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+)
+
+const defaultRegistry = "docker.io"
+
+// Registry serves images loaded from `docker save` tarballs over the registry HTTP API.
+//
+// Images are keyed by repository name without the registry host, so that single
+// registry instance can be used as a mirror for all the registries images were pulled from.
+type Registry struct {
+	blobs     map[string]blob
+	manifests map[string][]byte
+	hosts     map[string]struct{}
+}
+
+type blob struct {
+	tarball string
+	member  string
+	size    int64
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+type tarballManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// New creates empty registry.
+func New() *Registry {
+	return &Registry{
+		blobs:     map[string]blob{},
+		manifests: map[string][]byte{},
+		hosts:     map[string]struct{}{},
+	}
+}
+
+// LoadDir loads all the `*.tar` image tarballs from the directory.
+func (registry *Registry) LoadDir(dir string) error {
+	tarballs, err := filepath.Glob(filepath.Join(dir, "*.tar"))
+	if err != nil {
+		return err
+	}
+
+	if len(tarballs) == 0 {
+		return fmt.Errorf("no image tarballs found in %q", dir)
+	}
+
+	for _, tarball := range tarballs {
+		if err = registry.Load(tarball); err != nil {
+			return fmt.Errorf("error loading %q: %w", tarball, err)
+		}
+	}
+
+	return nil
+}
+
+// Load image tarball in `docker save` format.
+func (registry *Registry) Load(tarball string) error {
+	var tarballManifests []tarballManifest
+
+	// tarball member name -> descriptor
+	members := map[string]descriptor{}
+
+	if err := walkTarball(tarball, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name == "manifest.json" {
+			return json.NewDecoder(r).Decode(&tarballManifests)
+		}
+
+		hash := sha256.New()
+
+		size, err := io.Copy(hash, r)
+		if err != nil {
+			return err
+		}
+
+		blobDigest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+
+		members[hdr.Name] = descriptor{
+			Digest: blobDigest,
+			Size:   size,
+		}
+
+		registry.blobs[blobDigest] = blob{
+			tarball: tarball,
+			member:  hdr.Name,
+			size:    size,
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if tarballManifests == nil {
+		return errors.New("manifest.json not found")
+	}
+
+	for _, tm := range tarballManifests {
+		m := manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeManifest,
+		}
+
+		var err error
+
+		if m.Config, err = lookupMember(members, tm.Config, MediaTypeConfig); err != nil {
+			return err
+		}
+
+		for _, layer := range tm.Layers {
+			var d descriptor
+
+			if d, err = lookupMember(members, layer, MediaTypeLayer); err != nil {
+				return err
+			}
+
+			m.Layers = append(m.Layers, d)
+		}
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+
+		manifestDigest := digest(data)
+
+		for _, repoTag := range tm.RepoTags {
+			host, repo, tag := parseReference(repoTag)
+
+			registry.hosts[host] = struct{}{}
+			registry.manifests[repo+":"+tag] = data
+			registry.manifests[repo+"@"+manifestDigest] = data
+		}
+	}
+
+	return nil
+}
+
+// Hosts returns the list of registries the images were loaded for.
+func (registry *Registry) Hosts() []string {
+	hosts := make([]string, 0, len(registry.hosts))
+
+	for host := range registry.hosts {
+		hosts = append(hosts, host)
+	}
+
+	sort.Strings(hosts)
+
+	return hosts
+}
+
+// ServeHTTP implements http.Handler.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	p := strings.TrimPrefix(path.Clean(req.URL.Path), "/v2")
+
+	if p == "" || p == "/" {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		w.WriteHeader(http.StatusOK)
+
+		return
+	}
+
+	if idx := strings.LastIndex(p, "/manifests/"); idx > 0 {
+		registry.serveManifest(w, req, p[1:idx], p[idx+len("/manifests/"):])
+
+		return
+	}
+
+	if idx := strings.LastIndex(p, "/blobs/"); idx > 0 {
+		registry.serveBlob(w, req, p[idx+len("/blobs/"):])
+
+		return
+	}
+
+	http.NotFound(w, req)
+}
+
+func (registry *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repo, reference string) {
+	key := repo + ":" + reference
+	if strings.HasPrefix(reference, "sha256:") {
+		key = repo + "@" + reference
+	}
+
+	data, ok := registry.manifests[key]
+	if !ok {
+		http.NotFound(w, req)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", MediaTypeManifest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Docker-Content-Digest", digest(data))
+	w.WriteHeader(http.StatusOK)
+
+	if req.Method == http.MethodGet {
+		w.Write(data) //nolint: errcheck
+	}
+}
+
+func (registry *Registry) serveBlob(w http.ResponseWriter, req *http.Request, blobDigest string) {
+	b, ok := registry.blobs[blobDigest]
+	if !ok {
+		http.NotFound(w, req)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(b.size, 10))
+	w.Header().Set("Docker-Content-Digest", blobDigest)
+	w.WriteHeader(http.StatusOK)
+
+	if req.Method != http.MethodGet {
+		return
+	}
+
+	errFound := errors.New("found")
+
+	//nolint: errcheck
+	walkTarball(b.tarball, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name != b.member {
+			return nil
+		}
+
+		io.Copy(w, r) //nolint: errcheck
+
+		return errFound
+	})
+}
+
+func lookupMember(members map[string]descriptor, member, mediaType string) (descriptor, error) {
+	d, ok := members[member]
+	if !ok {
+		return descriptor{}, fmt.Errorf("member %q not found in the tarball", member)
+	}
+
+	d.MediaType = mediaType
+
+	return d, nil
+}
+
+func walkTarball(tarball string, f func(hdr *tar.Header, r io.Reader) error) error {
+	in, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close() //nolint: errcheck
+
+	tr := tar.NewReader(in)
+
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err = f(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func digest(data []byte) string {
+	hash := sha256.Sum256(data)
+
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// parseReference splits image reference into registry host, repository and tag.
+func parseReference(ref string) (host, repo, tag string) {
+	tag = "latest"
+
+	if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		ref, tag = ref[:idx], ref[idx+1:]
+	}
+
+	host = defaultRegistry
+
+	if idx := strings.Index(ref, "/"); idx > 0 {
+		if first := ref[:idx]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, ref = first, ref[idx+1:]
+		}
+	}
+
+	if host == defaultRegistry && !strings.Contains(ref, "/") {
+		ref = "library/" + ref
+	}
+
+	return host, ref, tag
+}
@@ -0,0 +1,121 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package state persists the options environments were created with.
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the name of the file with the options in the provisioner state directory of the cluster.
+//
+// File is removed along with the state directory when the cluster is destroyed.
+const FileName = "sfyra.yaml"
+
+// Path returns the path to the options of the cluster.
+func Path(stateDir, name string) string {
+	return filepath.Join(stateDir, name, FileName)
+}
+
+// Save the options of the cluster.
+func Save(stateDir, name string, options interface{}) error {
+	contents, err := yaml.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(Path(stateDir, name), contents, 0o644)
+}
+
+// Load the options of the cluster.
+//
+// Error satisfies os.IsNotExist if the cluster was created without saving the options.
+func Load(stateDir, name string, options interface{}) error {
+	contents, err := ioutil.ReadFile(Path(stateDir, name))
+	if err != nil {
+		return err
+	}
+
+	return yaml.Unmarshal(contents, options)
+}
+
+// Diff compares the options (structs of the same type) field by field.
+//
+// Mismatches are described using the YAML names of the fields.
+func Diff(existing, requested interface{}) []string {
+	existingValue := reflect.ValueOf(existing)
+	requestedValue := reflect.ValueOf(requested)
+
+	var mismatches []string
+
+	for i := 0; i < existingValue.NumField(); i++ {
+		field := existingValue.Type().Field(i)
+
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+
+		a, b := existingValue.Field(i), requestedValue.Field(i)
+
+		if !equal(a, b) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %v (existing) != %v (requested)", name, a.Interface(), b.Interface()))
+		}
+	}
+
+	return mismatches
+}
+
+// equal compares the values, nil and empty slices are equal, as they can't be distinguished once saved.
+func equal(a, b reflect.Value) bool {
+	if a.Kind() == reflect.Slice && a.Len() == 0 && b.Len() == 0 {
+		return true
+	}
+
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// MismatchError is returned if the existing cluster was created with different options.
+type MismatchError struct {
+	Name       string
+	Mismatches []string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%q was created with different options: %s", e.Name, strings.Join(e.Mismatches, "; "))
+}
+
+// Verify compares the saved options of the existing cluster with the requested ones.
+//
+// If the options were not saved, the cluster is assumed to match.
+func Verify(stateDir, name string, requested interface{}) error {
+	existing := reflect.New(reflect.TypeOf(requested))
+
+	if err := Load(stateDir, name, existing.Interface()); err != nil {
+		if os.IsNotExist(err) {
+			fmt.Printf("%q was created without saving the options, assuming they match\n", name)
+
+			return nil
+		}
+
+		return err
+	}
+
+	if mismatches := Diff(existing.Elem().Interface(), requested); len(mismatches) > 0 {
+		return &MismatchError{
+			Name:       name,
+			Mismatches: mismatches,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,610 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cabpt "github.com/talos-systems/cluster-api-bootstrap-provider-talos/api/v1alpha3"
+	cacpt "github.com/talos-systems/cluster-api-control-plane-provider-talos/api/v1alpha3"
+	"github.com/talos-systems/go-retry/retry"
+	sidero "github.com/talos-systems/sidero/app/cluster-api-provider-sidero/api/v1alpha3"
+	metal "github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	clientconfig "github.com/talos-systems/talos/pkg/machinery/client/config"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/cluster-api/api/v1alpha3"
+	capiclient "sigs.k8s.io/cluster-api/cmd/clusterctl/client"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/loadbalancer"
+	"github.com/talos-systems/sfyra/pkg/talos"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+// ClusterOptions configure the workload cluster.
+type ClusterOptions struct {
+	Namespace string
+	Name      string
+
+	KubernetesVersion string
+
+	ControlPlaneServerClass string
+	WorkerServerClass       string
+
+	ControlPlaneNodes int64
+	WorkerNodes       int64
+
+	// Port for the control plane load balancer, zero value means auto-allocated port.
+	LBPort int
+}
+
+// Cluster is a workload cluster fixture deployed via CAPI.
+type Cluster struct {
+	options ClusterOptions
+
+	metalClient      client.Client
+	bootstrapCluster talos.Cluster
+	vmSet            *vm.Set
+	capiManager      *capi.Manager
+
+	lb *loadbalancer.ControlPlane
+}
+
+// NewCluster creates the namespace and the control plane load balancer for the workload cluster.
+//
+// Cluster is not deployed until Deploy is called.
+func NewCluster(ctx context.Context, metalClient client.Client, bootstrapCluster talos.Cluster, vmSet *vm.Set, capiManager *capi.Manager, options ClusterOptions) (*Cluster, error) {
+	if options.Namespace == "" {
+		options.Namespace = "default"
+	}
+
+	if options.ControlPlaneServerClass == "" {
+		options.ControlPlaneServerClass = serverClassName
+	}
+
+	if options.WorkerServerClass == "" {
+		options.WorkerServerClass = options.ControlPlaneServerClass
+	}
+
+	cluster := &Cluster{
+		options:          options,
+		metalClient:      metalClient,
+		bootstrapCluster: bootstrapCluster,
+		vmSet:            vmSet,
+		capiManager:      capiManager,
+	}
+
+	clientset, err := bootstrapCluster.KubernetesClient().K8sClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = clientset.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: options.Namespace,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	cluster.lb, err = loadbalancer.NewControlPlane(metalClient, vmSet.BridgeIP(), options.LBPort, options.Namespace, options.Name, vmSet.Nodes())
+	if err != nil {
+		return nil, err
+	}
+
+	return cluster, nil
+}
+
+// Name of the cluster.
+func (cluster *Cluster) Name() string {
+	return cluster.options.Name
+}
+
+// Namespace of the cluster.
+func (cluster *Cluster) Namespace() string {
+	return cluster.options.Namespace
+}
+
+// Close the control plane load balancer.
+//
+// Close doesn't destroy the cluster.
+func (cluster *Cluster) Close() error {
+	return cluster.lb.Close()
+}
+
+// Deploy applies the cluster template and waits for the cluster to be ready.
+func (cluster *Cluster) Deploy(ctx context.Context) error {
+	if err := cluster.apply(ctx); err != nil {
+		return err
+	}
+
+	log.Printf("waiting for the cluster %s/%s to be provisioned", cluster.options.Namespace, cluster.options.Name)
+
+	return retry.Constant(10*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+		var capiCluster v1alpha3.Cluster
+
+		if err := cluster.metalClient.Get(ctx, cluster.key(), &capiCluster); err != nil {
+			return retry.UnexpectedError(err)
+		}
+
+		for _, cond := range capiCluster.Status.Conditions {
+			if cond.Type == v1alpha3.ReadyCondition && cond.Status == corev1.ConditionTrue {
+				return nil
+			}
+		}
+
+		return retry.ExpectedError(fmt.Errorf("cluster %s/%s is not ready", cluster.options.Namespace, cluster.options.Name))
+	})
+}
+
+func (cluster *Cluster) apply(ctx context.Context) error {
+	kubeconfig, err := cluster.capiManager.GetKubeconfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	config, err := cluster.bootstrapCluster.KubernetesClient().K8sRestConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	templateOptions := capiclient.GetClusterTemplateOptions{
+		Kubeconfig:               kubeconfig,
+		ClusterName:              cluster.options.Name,
+		TargetNamespace:          cluster.options.Namespace,
+		ControlPlaneMachineCount: &cluster.options.ControlPlaneNodes,
+		WorkerMachineCount:       &cluster.options.WorkerNodes,
+	}
+
+	template, err := cluster.capiManager.GetClusterTemplate(templateOptions, map[string]string{
+		"CONTROL_PLANE_ENDPOINT":    "localhost",
+		"CONTROL_PLANE_SERVERCLASS": cluster.options.ControlPlaneServerClass,
+		"WORKER_SERVERCLASS":        cluster.options.WorkerServerClass,
+		"KUBERNETES_VERSION":        cluster.options.KubernetesVersion,
+	})
+	if err != nil {
+		return err
+	}
+
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc))
+
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range template.Objs() {
+		var mapping *meta.RESTMapping
+
+		mapping, err = mapper.RESTMapping(obj.GroupVersionKind().GroupKind(), obj.GroupVersionKind().Version)
+		if err != nil {
+			return err
+		}
+
+		var dr dynamic.ResourceInterface
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			// namespaced resources should specify the namespace
+			dr = dyn.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+		} else {
+			// for cluster-wide resources
+			dr = dyn.Resource(mapping.Resource)
+		}
+
+		if obj.GroupVersionKind().Kind == "MetalCluster" {
+			host, portStr, _ := net.SplitHostPort(cluster.lb.GetEndpoint()) //nolint: errcheck
+			port, _ := strconv.Atoi(portStr)                                //nolint: errcheck
+
+			if err = unstructured.SetNestedMap(obj.Object, map[string]interface{}{
+				"host": host,
+				"port": float64(port),
+			}, "spec", "controlPlaneEndpoint"); err != nil {
+				return err
+			}
+		}
+
+		var data []byte
+
+		data, err = obj.MarshalJSON()
+		if err != nil {
+			return err
+		}
+
+		log.Printf("applying %s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+
+		obj := obj
+
+		_, err = dr.Create(ctx, &obj, metav1.CreateOptions{})
+		if err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				_, err = dr.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+					FieldManager: "sfyra",
+				})
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Health runs Talos health checks against the cluster.
+func (cluster *Cluster) Health(ctx context.Context) error {
+	talosClient, endpoints, err := cluster.TalosClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	return talosHealth(ctx, talosClient, endpoints)
+}
+
+// TalosClient builds Talos API client for the cluster using the first control plane machine as an endpoint.
+func (cluster *Cluster) TalosClient(ctx context.Context) (*talosclient.Client, []string, error) {
+	var (
+		capiCluster  v1alpha3.Cluster
+		controlPlane cacpt.TalosControlPlane
+		machines     v1alpha3.MachineList
+		talosConfig  cabpt.TalosConfig
+	)
+
+	if err := cluster.metalClient.Get(ctx, cluster.key(), &capiCluster); err != nil {
+		return nil, nil, err
+	}
+
+	if err := cluster.metalClient.Get(ctx,
+		types.NamespacedName{Namespace: capiCluster.Spec.ControlPlaneRef.Namespace, Name: capiCluster.Spec.ControlPlaneRef.Name},
+		&controlPlane); err != nil {
+		return nil, nil, err
+	}
+
+	labelSelector, err := labels.Parse(controlPlane.Status.Selector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = cluster.metalClient.List(ctx, &machines, client.MatchingLabelsSelector{Selector: labelSelector}); err != nil {
+		return nil, nil, err
+	}
+
+	if len(machines.Items) < 1 {
+		return nil, nil, fmt.Errorf("no control plane machines found for cluster %s/%s", cluster.options.Namespace, cluster.options.Name)
+	}
+
+	configRef := machines.Items[0].Spec.Bootstrap.ConfigRef
+
+	if err = cluster.metalClient.Get(ctx, types.NamespacedName{Namespace: configRef.Namespace, Name: configRef.Name}, &talosConfig); err != nil {
+		return nil, nil, err
+	}
+
+	clientConfig, err := clientconfig.FromString(talosConfig.Status.TalosConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// TODO: endpoints in talosconfig should be filled by Sidero
+	var metalMachine sidero.MetalMachine
+
+	if err = cluster.metalClient.Get(ctx,
+		types.NamespacedName{Namespace: machines.Items[0].Spec.InfrastructureRef.Namespace, Name: machines.Items[0].Spec.InfrastructureRef.Name},
+		&metalMachine); err != nil {
+		return nil, nil, err
+	}
+
+	if metalMachine.Spec.ServerRef == nil {
+		return nil, nil, fmt.Errorf("no server allocated for machine %q", machines.Items[0].Name)
+	}
+
+	nodeUUID := metalMachine.Spec.ServerRef.Name
+
+	for _, node := range cluster.vmSet.Nodes() {
+		if node.UUID.String() == nodeUUID {
+			clientConfig.Contexts[clientConfig.Context].Endpoints = append(clientConfig.Contexts[clientConfig.Context].Endpoints, node.PrivateIP.String())
+		}
+	}
+
+	talosClient, err := talosclient.New(ctx, talosclient.WithConfig(clientConfig))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return talosClient, clientConfig.Contexts[clientConfig.Context].Endpoints, nil
+}
+
+// KubernetesClient builds Kubernetes client for the workload cluster from the kubeconfig generated by CAPI.
+func (cluster *Cluster) KubernetesClient(ctx context.Context) (*kubernetes.Clientset, error) {
+	bootstrapClientset, err := cluster.bootstrapCluster.KubernetesClient().K8sClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := bootstrapClientset.CoreV1().Secrets(cluster.options.Namespace).Get(ctx, cluster.options.Name+"-kubeconfig", metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig(secret.Data["value"])
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// Machines returns the list of the cluster machines.
+func (cluster *Cluster) Machines(ctx context.Context) ([]v1alpha3.Machine, error) {
+	var machines v1alpha3.MachineList
+
+	if err := cluster.metalClient.List(ctx, &machines,
+		client.InNamespace(cluster.options.Namespace),
+		client.MatchingLabels{v1alpha3.ClusterLabelName: cluster.options.Name}); err != nil {
+		return nil, err
+	}
+
+	return machines.Items, nil
+}
+
+// Servers returns the map of machine name to the server allocated for it.
+func (cluster *Cluster) Servers(ctx context.Context) (map[string]string, error) {
+	machines, err := cluster.Machines(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := map[string]string{}
+
+	for _, machine := range machines {
+		var metalMachine sidero.MetalMachine
+
+		if err = cluster.metalClient.Get(ctx,
+			types.NamespacedName{Namespace: machine.Spec.InfrastructureRef.Namespace, Name: machine.Spec.InfrastructureRef.Name},
+			&metalMachine); err != nil {
+			return nil, err
+		}
+
+		if metalMachine.Spec.ServerRef == nil {
+			continue
+		}
+
+		servers[machine.Name] = metalMachine.Spec.ServerRef.Name
+	}
+
+	return servers, nil
+}
+
+// SetKubernetesVersion bumps Kubernetes version in the TalosControlPlane and MachineDeployments of the cluster.
+func (cluster *Cluster) SetKubernetesVersion(ctx context.Context, kubernetesVersion string) error {
+	var (
+		capiCluster  v1alpha3.Cluster
+		controlPlane cacpt.TalosControlPlane
+	)
+
+	if err := cluster.metalClient.Get(ctx, cluster.key(), &capiCluster); err != nil {
+		return err
+	}
+
+	if err := cluster.metalClient.Get(ctx,
+		types.NamespacedName{Namespace: capiCluster.Spec.ControlPlaneRef.Namespace, Name: capiCluster.Spec.ControlPlaneRef.Name},
+		&controlPlane); err != nil {
+		return err
+	}
+
+	patchHelper, err := patch.NewHelper(&controlPlane, cluster.metalClient)
+	if err != nil {
+		return err
+	}
+
+	controlPlane.Spec.Version = kubernetesVersion
+
+	if err = patchHelper.Patch(ctx, &controlPlane); err != nil {
+		return err
+	}
+
+	var machineDeployments v1alpha3.MachineDeploymentList
+
+	if err = cluster.metalClient.List(ctx, &machineDeployments,
+		client.InNamespace(cluster.options.Namespace),
+		client.MatchingLabels{v1alpha3.ClusterLabelName: cluster.options.Name}); err != nil {
+		return err
+	}
+
+	for _, machineDeployment := range machineDeployments.Items {
+		machineDeployment := machineDeployment
+
+		patchHelper, err = patch.NewHelper(&machineDeployment, cluster.metalClient)
+		if err != nil {
+			return err
+		}
+
+		machineDeployment.Spec.Template.Spec.Version = &kubernetesVersion
+
+		if err = patchHelper.Patch(ctx, &machineDeployment); err != nil {
+			return err
+		}
+	}
+
+	cluster.options.KubernetesVersion = kubernetesVersion
+
+	return nil
+}
+
+// Delete the cluster and wait for its resources to be removed.
+func (cluster *Cluster) Delete(ctx context.Context) error {
+	var capiCluster v1alpha3.Cluster
+
+	err := cluster.metalClient.Get(ctx, cluster.key(), &capiCluster)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("deleting cluster %s/%s", cluster.options.Namespace, cluster.options.Name)
+
+	if err = cluster.metalClient.Delete(ctx, &capiCluster); err != nil {
+		return err
+	}
+
+	return retry.Constant(10*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+		if err = cluster.metalClient.Get(ctx, cluster.key(), &capiCluster); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+
+			return retry.UnexpectedError(err)
+		}
+
+		return retry.ExpectedError(fmt.Errorf("cluster %s/%s is being deleted", cluster.options.Namespace, cluster.options.Name))
+	})
+}
+
+func (cluster *Cluster) key() types.NamespacedName {
+	return types.NamespacedName{Namespace: cluster.options.Namespace, Name: cluster.options.Name}
+}
+
+// deployCluster creates and deploys the cluster with the specified options.
+//
+// If selected is set, free servers it doesn't select are temporarily unaccepted, so that the cluster gets only the
+// selected ones. Returned cleanup function deletes the cluster and accepts the servers back.
+func deployCluster(ctx context.Context, t *testing.T, metalClient client.Client, bootstrapCluster talos.Cluster, vmSet *vm.Set,
+	capiManager *capi.Manager, options ClusterOptions, selected func(serverName string) bool) (cluster *Cluster, cleanup func()) {
+	var unaccepted []string
+
+	cleanup = func() {
+		for _, serverName := range unaccepted {
+			assert.NoError(t, setAccepted(ctx, metalClient, serverName, true))
+		}
+	}
+
+	if selected != nil {
+		var servers metal.ServerList
+
+		require.NoError(t, metalClient.List(ctx, &servers))
+
+		for _, server := range servers.Items {
+			if server.Status.InUse || !server.Spec.Accepted || selected(server.Name) {
+				continue
+			}
+
+			if err := setAccepted(ctx, metalClient, server.Name, false); err != nil {
+				cleanup()
+
+				require.NoError(t, err)
+			}
+
+			unaccepted = append(unaccepted, server.Name)
+		}
+
+		if err := waitServersUnavailable(ctx, metalClient, unaccepted); err != nil {
+			cleanup()
+
+			require.NoError(t, err)
+		}
+	}
+
+	cluster, err := NewCluster(ctx, metalClient, bootstrapCluster, vmSet, capiManager, options)
+	if err != nil {
+		cleanup()
+
+		require.NoError(t, err)
+	}
+
+	acceptServers := cleanup
+
+	// release the servers even if the cluster failed to deploy
+	cleanup = func() {
+		assert.NoError(t, cluster.Delete(ctx))
+		cluster.Close() //nolint: errcheck
+
+		acceptServers()
+	}
+
+	if err = cluster.Deploy(ctx); err != nil {
+		cleanup()
+
+		require.NoError(t, err)
+	}
+
+	return cluster, cleanup
+}
+
+// serverNodes maps the servers to the names of the VMs of the set.
+func serverNodes(vmSet *vm.Set) map[string]string {
+	nodes := map[string]string{}
+
+	for _, node := range vmSet.Nodes() {
+		nodes[node.UUID.String()] = node.Name
+	}
+
+	return nodes
+}
+
+// consoleLines returns the rest of the VM console log lines after the marker.
+func consoleLines(consoleLogPath, marker string) ([]string, error) {
+	f, err := os.Open(consoleLogPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint: errcheck
+
+	var lines []string
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		if idx := strings.Index(scanner.Text(), marker); idx != -1 {
+			lines = append(lines, scanner.Text()[idx+len(marker):])
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// bootCmdlines returns kernel command lines of all the boots recorded in the VM console log.
+func bootCmdlines(consoleLogPath string) ([]string, error) {
+	return consoleLines(consoleLogPath, "Kernel command line: ")
+}
+
+// uefiBootOptions returns the boot options OVMF loaded as recorded in the VM console log.
+func uefiBootOptions(consoleLogPath string) ([]string, error) {
+	return consoleLines(consoleLogPath, "BdsDxe: loading ")
+}
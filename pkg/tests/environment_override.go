@@ -0,0 +1,192 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/talos-systems/go-retry/retry"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/talos"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+const (
+	alternateEnvironmentName = "sfyra-alternate"
+	alternateEnvironmentArg  = "sfyra.environment=alternate"
+
+	environmentClusterName   = "environment-cluster"
+	environmentClusterLBPort = 10200
+)
+
+// TestEnvironmentOverride binds one of the free servers to the alternate Environment, deploys the cluster on it and
+// another free server, and verifies that Sidero serves the alternate Environment assets to the bound server, and the
+// bound server booted with the alternate kernel args, while the unbound one got the default Environment.
+//
+// Other free servers are temporarily unaccepted, so that the cluster gets exactly the bound and the unbound server.
+func TestEnvironmentOverride(ctx context.Context, metalClient client.Client, cluster talos.Cluster, vmSet *vm.Set, capiManager *capi.Manager, options Options) TestFunc {
+	return func(t *testing.T) {
+		var defaultEnvironment v1alpha1.Environment
+
+		require.NoError(t, metalClient.Get(ctx, types.NamespacedName{Name: environmentName}, &defaultEnvironment))
+
+		environment := v1alpha1.Environment{}
+		environment.APIVersion = "metal.sidero.dev/v1alpha1"
+		environment.Name = alternateEnvironmentName
+		environment.Spec = *defaultEnvironment.Spec.DeepCopy()
+		environment.Spec.Kernel.Args = append(environment.Spec.Kernel.Args, alternateEnvironmentArg)
+
+		if err := metalClient.Create(ctx, &environment); err != nil && !apierrors.IsAlreadyExists(err) {
+			require.NoError(t, err)
+		}
+
+		defer metalClient.Delete(ctx, &environment) //nolint: errcheck
+
+		require.NoError(t, retry.Constant(5*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+			if err := metalClient.Get(ctx, types.NamespacedName{Name: alternateEnvironmentName}, &environment); err != nil {
+				return retry.UnexpectedError(err)
+			}
+
+			if !environmentReady(&environment) {
+				return retry.ExpectedError(fmt.Errorf("environment %q is not ready", alternateEnvironmentName))
+			}
+
+			return nil
+		}))
+
+		var servers v1alpha1.ServerList
+
+		require.NoError(t, metalClient.List(ctx, &servers))
+
+		var free []string
+
+		for _, server := range servers.Items {
+			if !server.Status.InUse && server.Spec.Accepted {
+				free = append(free, server.Name)
+			}
+		}
+
+		require.GreaterOrEqual(t, len(free), 2, "test requires two free servers")
+
+		boundServer, unboundServer := free[0], free[1]
+
+		require.NoError(t, setEnvironmentRef(ctx, metalClient, boundServer, &corev1.ObjectReference{
+			APIVersion: "metal.sidero.dev/v1alpha1",
+			Kind:       "Environment",
+			Name:       alternateEnvironmentName,
+		}))
+
+		defer func() {
+			assert.NoError(t, setEnvironmentRef(ctx, metalClient, boundServer, nil))
+		}()
+
+		nodeNames := serverNodes(vmSet)
+
+		// only the boots after the Environment change are verified
+		bootsBefore := map[string]int{}
+
+		for _, serverName := range []string{boundServer, unboundServer} {
+			cmdlines, err := bootCmdlines(vmSet.ConsoleLogPath(nodeNames[serverName]))
+			require.NoError(t, err)
+
+			bootsBefore[serverName] = len(cmdlines)
+		}
+
+		environmentCluster, cleanup := deployCluster(ctx, t, metalClient, cluster, vmSet, capiManager, ClusterOptions{
+			Name:              environmentClusterName,
+			KubernetesVersion: options.KubernetesVersion,
+			ControlPlaneNodes: 1,
+			WorkerNodes:       1,
+			LBPort:            environmentClusterLBPort,
+		}, func(serverName string) bool {
+			return serverName == boundServer || serverName == unboundServer
+		})
+		defer cleanup()
+
+		allocated, err := environmentCluster.Servers(ctx)
+		require.NoError(t, err)
+
+		allocatedServers := make([]string, 0, len(allocated))
+
+		for _, serverName := range allocated {
+			allocatedServers = append(allocatedServers, serverName)
+		}
+
+		require.ElementsMatch(t, []string{boundServer, unboundServer}, allocatedServers)
+
+		for serverName, envName := range map[string]string{boundServer: alternateEnvironmentName, unboundServer: environmentName} {
+			var mac net.HardwareAddr
+
+			mac, err = vmSet.NodeMAC(nodeNames[serverName])
+			require.NoError(t, err)
+
+			// Sidero serves the Environment assets under the Environment name
+			kernel, initrd, args := fetchIPXE(ctx, t, ipxeBaseURL(cluster), serverName, mac)
+
+			assert.Equal(t, "/env/"+envName+"/vmlinuz", kernel.Path, "server %q", serverName)
+			assert.Equal(t, "/env/"+envName+"/initrd", initrd.Path, "server %q", serverName)
+			assert.Equal(t, envName == alternateEnvironmentName, contains(args, alternateEnvironmentArg), "server %q", serverName)
+
+			assertAssetsServed(ctx, t, kernel, initrd)
+
+			var cmdlines []string
+
+			cmdlines, err = bootCmdlines(vmSet.ConsoleLogPath(nodeNames[serverName]))
+			require.NoError(t, err)
+
+			cmdlines = cmdlines[bootsBefore[serverName]:]
+			require.NotEmpty(t, cmdlines, "server %q didn't boot after the environment change", serverName)
+
+			if envName == alternateEnvironmentName {
+				assert.True(t, anyContains(cmdlines, alternateEnvironmentArg), "server %q should boot with the alternate environment", serverName)
+			} else {
+				assert.False(t, anyContains(cmdlines, alternateEnvironmentArg), "server %q should boot with the default environment", serverName)
+			}
+		}
+	}
+}
+
+func setEnvironmentRef(ctx context.Context, metalClient client.Client, serverName string, ref *corev1.ObjectReference) error {
+	var server v1alpha1.Server
+
+	if err := metalClient.Get(ctx, types.NamespacedName{Name: serverName}, &server); err != nil {
+		return err
+	}
+
+	patchHelper, err := patch.NewHelper(&server, metalClient)
+	if err != nil {
+		return err
+	}
+
+	server.Spec.EnvironmentRef = ref
+
+	return patchHelper.Patch(ctx, &server)
+}
+
+func anyContains(cmdlines []string, arg string) bool {
+	for _, cmdline := range cmdlines {
+		for _, field := range strings.Fields(cmdline) {
+			if field == arg {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/talos-systems/go-retry/retry"
+	metal "github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/talos"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+const (
+	upgradeClusterName   = "upgrade-cluster"
+	upgradeClusterLBPort = 10100
+)
+
+// TestKubernetesUpgrade deploys the cluster at one Kubernetes version and upgrades it to another one via TalosControlPlane and MachineDeployment.
+//
+// Test requires free servers for the cluster itself and the rolling replacement of the machines.
+func TestKubernetesUpgrade(ctx context.Context, metalClient client.Client, cluster talos.Cluster, vmSet *vm.Set, capiManager *capi.Manager, options Options) TestFunc {
+	return func(t *testing.T) {
+		if options.KubernetesUpgradeVersion == "" {
+			t.Skip("Kubernetes upgrade version is not set")
+		}
+
+		upgradeCluster, cleanup := deployCluster(ctx, t, metalClient, cluster, vmSet, capiManager, ClusterOptions{
+			Name:              upgradeClusterName,
+			KubernetesVersion: options.KubernetesVersion,
+			ControlPlaneNodes: 1,
+			WorkerNodes:       1,
+			LBPort:            upgradeClusterLBPort,
+		}, nil)
+		defer cleanup()
+
+		require.NoError(t, upgradeCluster.Health(ctx))
+
+		serversBefore, err := upgradeCluster.Servers(ctx)
+		require.NoError(t, err)
+
+		t.Logf("upgrading cluster %q from %s to %s", upgradeClusterName, options.KubernetesVersion, options.KubernetesUpgradeVersion)
+
+		require.NoError(t, upgradeCluster.SetKubernetesVersion(ctx, options.KubernetesUpgradeVersion))
+
+		t.Log("waiting for the machines to be replaced")
+
+		require.NoError(t, retry.Constant(30*time.Minute, retry.WithUnits(30*time.Second)).Retry(func() error {
+			return checkMachinesVersion(ctx, upgradeCluster, options.KubernetesUpgradeVersion)
+		}))
+
+		require.NoError(t, upgradeCluster.Health(ctx))
+
+		clientset, err := upgradeCluster.KubernetesClient(ctx)
+		require.NoError(t, err)
+
+		nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+
+		for _, node := range nodes.Items {
+			assert.Equal(t, options.KubernetesUpgradeVersion, node.Status.NodeInfo.KubeletVersion, "node %q", node.Name)
+		}
+
+		serversAfter, err := upgradeCluster.Servers(ctx)
+		require.NoError(t, err)
+
+		verifyServersReallocated(ctx, t, metalClient, serversBefore, serversAfter)
+	}
+}
+
+// checkMachinesVersion verifies that all the cluster machines are running at the specified version.
+func checkMachinesVersion(ctx context.Context, cluster *Cluster, kubernetesVersion string) error {
+	machines, err := cluster.Machines(ctx)
+	if err != nil {
+		return retry.UnexpectedError(err)
+	}
+
+	for _, machine := range machines {
+		if machine.Spec.Version == nil || *machine.Spec.Version != kubernetesVersion {
+			return retry.ExpectedError(fmt.Errorf("machine %q is not upgraded yet", machine.Name))
+		}
+
+		if machine.Status.Phase != string(v1alpha3.MachinePhaseRunning) || machine.Status.NodeRef == nil {
+			return retry.ExpectedError(fmt.Errorf("machine %q is not running yet: %q", machine.Name, machine.Status.Phase))
+		}
+	}
+
+	return nil
+}
+
+// verifyServersReallocated checks that servers of the replaced machines were released, and new machines got their own servers.
+func verifyServersReallocated(ctx context.Context, t *testing.T, metalClient client.Client, serversBefore, serversAfter map[string]string) {
+	inUse := map[string]string{}
+
+	for machineName, serverName := range serversAfter {
+		_, existed := serversBefore[machineName]
+		assert.False(t, existed, "machine %q was not replaced", machineName)
+
+		if prevMachine, ok := inUse[serverName]; ok {
+			assert.Fail(t, "server double allocation", "server %q is allocated to both %q and %q", serverName, prevMachine, machineName)
+		}
+
+		inUse[serverName] = machineName
+
+		var server metal.Server
+
+		require.NoError(t, metalClient.Get(ctx, types.NamespacedName{Name: serverName}, &server))
+		assert.True(t, server.Status.InUse, "server %q should be in use", serverName)
+	}
+
+	// servers of the replaced machines are released asynchronously
+	require.NoError(t, retry.Constant(5*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+		for _, serverName := range serversBefore {
+			if _, ok := inUse[serverName]; ok {
+				continue
+			}
+
+			var server metal.Server
+
+			if err := metalClient.Get(ctx, types.NamespacedName{Name: serverName}, &server); err != nil {
+				return retry.UnexpectedError(err)
+			}
+
+			if server.Status.InUse {
+				return retry.ExpectedError(fmt.Errorf("server %q is still in use", serverName))
+			}
+		}
+
+		return nil
+	}))
+}
@@ -0,0 +1,195 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sidero "github.com/talos-systems/sidero/app/cluster-api-provider-sidero/api/v1alpha3"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/talos"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+const (
+	metadataServerPort = 9091
+
+	// metadataNoConfigStatus is returned by the Sidero metadata server for the servers which have no machine config:
+	// servers it doesn't know about, and servers which are not referenced by any MetalMachine.
+	metadataNoConfigStatus = http.StatusNotFound
+
+	metadataClusterName   = "metadata-cluster"
+	metadataClusterLBPort = 10400
+)
+
+// TestMetadataServer calls the metadata server the same way PXE booted nodes do.
+//
+// Machine config for the allocated server should have the server config patches applied.
+// Test requires a free server, cluster is deployed if there are no allocated servers.
+func TestMetadataServer(ctx context.Context, metalClient client.Client, cluster talos.Cluster, vmSet *vm.Set, capiManager *capi.Manager, options Options) TestFunc {
+	return func(t *testing.T) {
+		configURL := func(serverUUID string) string {
+			return fmt.Sprintf("http://%s:%d/configdata?uuid=%s", cluster.SideroComponentsIP(), metadataServerPort, serverUUID)
+		}
+
+		var servers v1alpha1.ServerList
+
+		require.NoError(t, metalClient.List(ctx, &servers))
+
+		t.Run("UnknownUUID", func(t *testing.T) {
+			status, _, err := httpGet(ctx, configURL(uuid.New().String()))
+			require.NoError(t, err)
+
+			assert.Equal(t, metadataNoConfigStatus, status)
+		})
+
+		t.Run("NotAllocated", func(t *testing.T) {
+			var server *v1alpha1.Server
+
+			for i := range servers.Items {
+				if !servers.Items[i].Status.InUse {
+					server = &servers.Items[i]
+
+					break
+				}
+			}
+
+			require.NotNil(t, server, "test requires a free server")
+
+			status, _, err := httpGet(ctx, configURL(server.Name))
+			require.NoError(t, err)
+
+			assert.Equal(t, metadataNoConfigStatus, status)
+		})
+
+		t.Run("Allocated", func(t *testing.T) {
+			serverName, release := allocatedServer(ctx, t, metalClient, cluster, vmSet, capiManager, ClusterOptions{
+				Name:              metadataClusterName,
+				KubernetesVersion: options.KubernetesVersion,
+				LBPort:            metadataClusterLBPort,
+			})
+			defer release()
+
+			status, body, err := httpGet(ctx, configURL(serverName))
+			require.NoError(t, err)
+
+			require.Equal(t, http.StatusOK, status)
+
+			var config map[string]interface{}
+
+			require.NoError(t, yaml.Unmarshal(body, &config))
+
+			assert.Equal(t, installDisk, lookupPath(config, "machine", "install", "disk"))
+			assert.Equal(t, options.InstallerImage, lookupPath(config, "machine", "install", "image"))
+
+			for _, mirror := range options.RegistryMirrors {
+				parts := strings.SplitN(mirror, "=", 2)
+				require.Len(t, parts, 2)
+
+				assert.Equal(t, []interface{}{parts[1]}, lookupPath(config, "machine", "registries", "mirrors", parts[0], "endpoints"), "mirror %q", parts[0])
+			}
+
+			if len(options.Nameservers) > 0 {
+				nameservers := make([]interface{}, len(options.Nameservers))
+
+				for i := range options.Nameservers {
+					nameservers[i] = options.Nameservers[i]
+				}
+
+				assert.Equal(t, nameservers, lookupPath(config, "machine", "network", "nameservers"))
+			}
+		})
+	}
+}
+
+// allocatedServer returns the server allocated to any of the clusters.
+//
+// If there are no allocated servers, single-node cluster is deployed with the specified options, and it is deleted
+// by the returned release function.
+func allocatedServer(ctx context.Context, t *testing.T, metalClient client.Client, bootstrapCluster talos.Cluster, vmSet *vm.Set,
+	capiManager *capi.Manager, clusterOptions ClusterOptions) (serverName string, release func()) {
+	var metalMachines sidero.MetalMachineList
+
+	require.NoError(t, metalClient.List(ctx, &metalMachines))
+
+	for _, metalMachine := range metalMachines.Items {
+		if metalMachine.Spec.ServerRef != nil {
+			return metalMachine.Spec.ServerRef.Name, func() {}
+		}
+	}
+
+	t.Logf("no servers are allocated, deploying cluster %q", clusterOptions.Name)
+
+	clusterOptions.ControlPlaneNodes = 1
+	clusterOptions.WorkerNodes = 0
+
+	allocationCluster, release := deployCluster(ctx, t, metalClient, bootstrapCluster, vmSet, capiManager, clusterOptions, nil)
+
+	servers, err := allocationCluster.Servers(ctx)
+	if err == nil && len(servers) == 0 {
+		err = fmt.Errorf("no servers are allocated to cluster %q", clusterOptions.Name)
+	}
+
+	if err != nil {
+		release()
+
+		require.NoError(t, err)
+	}
+
+	for _, name := range servers {
+		serverName = name
+	}
+
+	return serverName, release
+}
+
+// httpGet fetches the URL returning the status code and the body.
+func httpGet(ctx context.Context, url string) (int, []byte, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer resp.Body.Close() //nolint: errcheck
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode, body, err
+}
+
+// lookupPath returns the value in the nested YAML maps, nil if the path doesn't exist.
+func lookupPath(obj interface{}, path ...string) interface{} {
+	for _, key := range path {
+		m, ok := obj.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		obj = m[key]
+	}
+
+	return obj
+}
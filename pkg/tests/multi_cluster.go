@@ -0,0 +1,207 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/talos-systems/go-retry/retry"
+	sidero "github.com/talos-systems/sidero/app/cluster-api-provider-sidero/api/v1alpha3"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/talos"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+// TestMultipleClusters deploys several workload clusters concurrently sharing the same set of servers.
+//
+// Each cluster lives in a separate namespace with its own ServerClass and control plane load balancer.
+func TestMultipleClusters(ctx context.Context, metalClient client.Client, cluster talos.Cluster, vmSet *vm.Set, capiManager *capi.Manager, options Options) TestFunc {
+	return func(t *testing.T) {
+		if options.MultiClusterCount == 0 {
+			t.Skip("multiple clusters test is disabled")
+		}
+
+		clientset, err := cluster.KubernetesClient().K8sClient(ctx)
+		require.NoError(t, err)
+
+		clusters := make([]*Cluster, options.MultiClusterCount)
+
+		for i := range clusters {
+			i := i
+			namespace := fmt.Sprintf("multi-%d", i)
+
+			serverClass := v1alpha1.ServerClass{}
+			serverClass.APIVersion = "metal.sidero.dev/v1alpha1"
+			serverClass.Name = namespace
+			serverClass.Spec.Qualifiers.CPU = append(serverClass.Spec.Qualifiers.CPU, qemuCPU)
+
+			if err = metalClient.Create(ctx, &serverClass); err != nil && !apierrors.IsAlreadyExists(err) {
+				require.NoError(t, err)
+			}
+
+			// cluster is deleted before its namespace and ServerClass
+			defer func() {
+				if clusters[i] != nil {
+					assert.NoError(t, clusters[i].Delete(ctx))
+					clusters[i].Close() //nolint: errcheck
+				}
+
+				assert.NoError(t, deleteNamespace(ctx, clientset, namespace))
+
+				if deleteErr := metalClient.Delete(ctx, &serverClass); deleteErr != nil && !apierrors.IsNotFound(deleteErr) {
+					assert.NoError(t, deleteErr)
+				}
+			}()
+
+			clusters[i], err = NewCluster(ctx, metalClient, cluster, vmSet, capiManager, ClusterOptions{
+				Namespace:               namespace,
+				Name:                    fmt.Sprintf("multi-cluster-%d", i),
+				KubernetesVersion:       options.KubernetesVersion,
+				ControlPlaneServerClass: serverClass.Name,
+				ControlPlaneNodes:       1,
+				WorkerNodes:             0,
+			})
+			require.NoError(t, err)
+		}
+
+		watchCtx, watchCancel := context.WithCancel(ctx)
+		defer watchCancel()
+
+		var watchErr error
+
+		watchDone := make(chan struct{})
+
+		go func() {
+			defer close(watchDone)
+
+			watchErr = watchServerAllocation(watchCtx, metalClient)
+		}()
+
+		var wg sync.WaitGroup
+
+		errs := make([]error, len(clusters))
+
+		for i := range clusters {
+			i := i
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				if errs[i] = clusters[i].Deploy(ctx); errs[i] != nil {
+					return
+				}
+
+				// health is verified while other clusters might still be provisioning
+				errs[i] = clusters[i].Health(ctx)
+			}()
+		}
+
+		wg.Wait()
+
+		watchCancel()
+		<-watchDone
+
+		for i := range clusters {
+			assert.NoError(t, errs[i], "cluster %s/%s", clusters[i].Namespace(), clusters[i].Name())
+		}
+
+		assert.NoError(t, watchErr)
+
+		allocated := map[string]string{}
+
+		for _, c := range clusters {
+			var servers map[string]string
+
+			servers, err = c.Servers(ctx)
+			require.NoError(t, err)
+
+			for _, server := range servers {
+				if prevCluster, ok := allocated[server]; ok {
+					assert.Fail(t, "server double allocation", "server %q is allocated to both %q and %q", server, prevCluster, c.Name())
+				}
+
+				allocated[server] = c.Name()
+			}
+		}
+	}
+}
+
+// deleteNamespace deletes the namespace and waits for it to be removed, so that it can be created again.
+func deleteNamespace(ctx context.Context, clientset *kubernetes.Clientset, namespace string) error {
+	err := clientset.CoreV1().Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return retry.Constant(5*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+		if _, err = clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{}); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+
+			return retry.UnexpectedError(err)
+		}
+
+		return retry.ExpectedError(fmt.Errorf("namespace %q is being deleted", namespace))
+	})
+}
+
+// watchServerAllocation checks periodically that no server is allocated to more than one MetalMachine.
+func watchServerAllocation(ctx context.Context, metalClient client.Client) error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		var metalMachines sidero.MetalMachineList
+
+		if err := metalClient.List(ctx, &metalMachines); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		allocated := map[string]string{}
+
+		for _, metalMachine := range metalMachines.Items {
+			if metalMachine.Spec.ServerRef == nil {
+				continue
+			}
+
+			machineName := metalMachine.Namespace + "/" + metalMachine.Name
+
+			if prevMachine, ok := allocated[metalMachine.Spec.ServerRef.Name]; ok {
+				return fmt.Errorf("server %q is allocated to both %q and %q", metalMachine.Spec.ServerRef.Name, prevMachine, machineName)
+			}
+
+			allocated[metalMachine.Spec.ServerRef.Name] = machineName
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/talos-systems/go-retry/retry"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	clusterctlv1 "sigs.k8s.io/cluster-api/cmd/clusterctl/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/talos"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+// TestProvidersUpgrade upgrades the providers with `clusterctl upgrade apply` under the running management cluster.
+//
+// Test expects the older provider versions to be installed (see capi.Options), existing Servers, Environments and the cluster
+// should stay healthy after the upgrade.
+func TestProvidersUpgrade(ctx context.Context, metalClient client.Client, cluster talos.Cluster, vmSet *vm.Set, capiManager *capi.Manager, options Options) TestFunc {
+	return func(t *testing.T) {
+		upgradeOptions := options.ProvidersUpgrade
+
+		if len(upgradeOptions.BootstrapProviders)+len(upgradeOptions.ControlPlaneProviders)+len(upgradeOptions.InfrastructureProviders) == 0 {
+			t.Skip("provider upgrade versions are not set")
+		}
+
+		managementCluster, err := NewCluster(ctx, metalClient, cluster, vmSet, capiManager, ClusterOptions{
+			Name:   managementClusterName,
+			LBPort: managementClusterLBPort,
+		})
+		require.NoError(t, err)
+
+		defer managementCluster.Close() //nolint: errcheck
+
+		var servers v1alpha1.ServerList
+
+		require.NoError(t, metalClient.List(ctx, &servers))
+
+		var environments v1alpha1.EnvironmentList
+
+		require.NoError(t, metalClient.List(ctx, &environments))
+
+		allocationBefore, err := managementCluster.Servers(ctx)
+		require.NoError(t, err)
+
+		t.Logf("upgrading providers: bootstrap %v, control plane %v, infrastructure %v",
+			upgradeOptions.BootstrapProviders, upgradeOptions.ControlPlaneProviders, upgradeOptions.InfrastructureProviders)
+
+		require.NoError(t, capiManager.Upgrade(ctx, upgradeOptions))
+
+		installed, err := capiManager.InstalledProviders(ctx)
+		require.NoError(t, err)
+
+		for providerType, specs := range map[clusterctlv1.ProviderType][]string{
+			clusterctlv1.BootstrapProviderType:      upgradeOptions.BootstrapProviders,
+			clusterctlv1.ControlPlaneProviderType:   upgradeOptions.ControlPlaneProviders,
+			clusterctlv1.InfrastructureProviderType: upgradeOptions.InfrastructureProviders,
+		} {
+			for _, s := range specs {
+				var spec capi.ProviderSpec
+
+				spec, err = capi.ParseProviderSpec(s)
+				require.NoError(t, err)
+
+				assert.Contains(t, installedVersions(installed, providerType, spec.Name), spec.Version, "%s %q", providerType, spec.Name)
+			}
+		}
+
+		// upgraded controllers should pick up existing objects
+		require.NoError(t, retry.Constant(5*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+			for _, server := range servers.Items {
+				var current v1alpha1.Server
+
+				if err = metalClient.Get(ctx, client.ObjectKey{Name: server.Name}, &current); err != nil {
+					return retry.UnexpectedError(err)
+				}
+
+				if !current.Status.Ready {
+					return retry.ExpectedError(fmt.Errorf("server %q is not ready", server.Name))
+				}
+
+				if current.Status.InUse != server.Status.InUse {
+					return retry.UnexpectedError(fmt.Errorf("server %q in use changed: %v -> %v", server.Name, server.Status.InUse, current.Status.InUse))
+				}
+			}
+
+			for _, environment := range environments.Items {
+				var current v1alpha1.Environment
+
+				if err = metalClient.Get(ctx, client.ObjectKey{Name: environment.Name}, &current); err != nil {
+					return retry.UnexpectedError(err)
+				}
+
+				if !environmentReady(&current) {
+					return retry.ExpectedError(fmt.Errorf("environment %q is not ready", environment.Name))
+				}
+			}
+
+			return nil
+		}))
+
+		allocationAfter, err := managementCluster.Servers(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, allocationBefore, allocationAfter, "server allocation should be kept")
+
+		require.NoError(t, managementCluster.Health(ctx))
+	}
+}
+
+func installedVersions(installed []clusterctlv1.Provider, providerType clusterctlv1.ProviderType, name string) []string {
+	var versions []string
+
+	for _, provider := range installed {
+		if provider.Type == string(providerType) && provider.ProviderName == name {
+			versions = append(versions, provider.Version)
+		}
+	}
+
+	return versions
+}
+
+// environmentReady checks that all the Environment assets are ready.
+func environmentReady(environment *v1alpha1.Environment) bool {
+	for _, cond := range environment.Status.Conditions {
+		if cond.Type == "Ready" && cond.Status != "True" {
+			return false
+		}
+	}
+
+	return len(environment.Status.Conditions) > 0
+}
@@ -0,0 +1,252 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/talos"
+	"github.com/talos-systems/sfyra/pkg/tftp"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+const (
+	ipxeHTTPPort = 8081
+	tftpPort     = 69
+
+	pxeClusterName   = "pxe-cluster"
+	pxeClusterLBPort = 10500
+
+	// agentEnvironmentName is the environment Sidero iPXE server boots the servers without the Environment into:
+	// the agent kernel and initrd are served from /env/agent/.
+	agentEnvironmentName = "agent"
+)
+
+// TestPXEEndpoints fetches iPXE binaries and boot scripts from Sidero the same way PXE booted nodes do.
+//
+// Servers which are not allocated should boot the agent environment, allocated servers boot their Environment.
+// Registered servers are queried with the UUID and the MAC of the VM.
+// Test requires a free server, cluster is deployed if there are no allocated servers.
+func TestPXEEndpoints(ctx context.Context, metalClient client.Client, cluster talos.Cluster, vmSet *vm.Set, capiManager *capi.Manager, options Options) TestFunc {
+	return func(t *testing.T) {
+		baseURL := ipxeBaseURL(cluster)
+
+		t.Run("TFTP", func(t *testing.T) {
+			tftpAddr := net.JoinHostPort(cluster.SideroComponentsIP().String(), strconv.Itoa(tftpPort))
+
+			for _, name := range []string{"undionly.kpxe", "ipxe.efi"} {
+				contents, err := tftp.Get(ctx, tftpAddr, name)
+				require.NoError(t, err, "fetching %q", name)
+
+				assert.NotEmpty(t, contents, "iPXE binary %q", name)
+
+				if strings.HasSuffix(name, ".efi") {
+					assert.True(t, bytes.HasPrefix(contents, []byte("MZ")), "%q should be PE executable", name)
+				}
+			}
+		})
+
+		t.Run("BootScript", func(t *testing.T) {
+			status, body, err := httpGet(ctx, baseURL+"/boot.ipxe")
+			require.NoError(t, err)
+
+			require.Equal(t, http.StatusOK, status)
+
+			script := string(body)
+			assert.True(t, strings.HasPrefix(script, "#!ipxe"), "script: %s", script)
+			assert.Contains(t, script, "chain")
+			assert.Contains(t, script, "uuid=${uuid}")
+		})
+
+		t.Run("Unregistered", func(t *testing.T) {
+			kernel, initrd, args := fetchIPXE(ctx, t, baseURL, uuid.New().String(), randomMAC(t))
+
+			assertAgentBoot(ctx, t, kernel, initrd, args)
+		})
+
+		nodeNames := serverNodes(vmSet)
+
+		nodeMAC := func(t *testing.T, serverName string) net.HardwareAddr {
+			nodeName, ok := nodeNames[serverName]
+			require.True(t, ok, "server %q is not a VM of the management set", serverName)
+
+			mac, err := vmSet.NodeMAC(nodeName)
+			require.NoError(t, err)
+
+			return mac
+		}
+
+		t.Run("Registered", func(t *testing.T) {
+			var servers v1alpha1.ServerList
+
+			require.NoError(t, metalClient.List(ctx, &servers))
+
+			var serverName string
+
+			for _, server := range servers.Items {
+				if _, ok := nodeNames[server.Name]; ok && !server.Status.InUse {
+					serverName = server.Name
+
+					break
+				}
+			}
+
+			require.NotEmpty(t, serverName, "test requires a free server")
+
+			kernel, initrd, args := fetchIPXE(ctx, t, baseURL, serverName, nodeMAC(t, serverName))
+
+			assertAgentBoot(ctx, t, kernel, initrd, args)
+
+			// free server should be running the agent it got with the same script
+			cmdlines, err := bootCmdlines(vmSet.ConsoleLogPath(nodeNames[serverName]))
+			require.NoError(t, err)
+			require.NotEmpty(t, cmdlines, "no boots recorded for server %q", serverName)
+
+			lastCmdline := strings.Fields(cmdlines[len(cmdlines)-1])
+
+			for _, arg := range args {
+				assert.Contains(t, lastCmdline, arg, "server %q is not running the agent", serverName)
+			}
+		})
+
+		t.Run("Allocated", func(t *testing.T) {
+			serverName, release := allocatedServer(ctx, t, metalClient, cluster, vmSet, capiManager, ClusterOptions{
+				Name:              pxeClusterName,
+				KubernetesVersion: options.KubernetesVersion,
+				LBPort:            pxeClusterLBPort,
+			})
+			defer release()
+
+			var server v1alpha1.Server
+
+			require.NoError(t, metalClient.Get(ctx, types.NamespacedName{Name: serverName}, &server))
+
+			envName := environmentName
+			if server.Spec.EnvironmentRef != nil {
+				envName = server.Spec.EnvironmentRef.Name
+			}
+
+			var environment v1alpha1.Environment
+
+			require.NoError(t, metalClient.Get(ctx, types.NamespacedName{Name: envName}, &environment))
+
+			kernel, initrd, args := fetchIPXE(ctx, t, baseURL, serverName, nodeMAC(t, serverName))
+
+			assert.Equal(t, "/env/"+envName+"/vmlinuz", kernel.Path)
+			assert.Equal(t, "/env/"+envName+"/initrd", initrd.Path)
+
+			for _, arg := range environment.Spec.Kernel.Args {
+				assert.Contains(t, args, arg)
+			}
+
+			// assets are downloaded by Sidero from the Environment URLs and served locally
+			assertAssetsServed(ctx, t, kernel, initrd)
+		})
+	}
+}
+
+// ipxeBaseURL returns the URL of the Sidero iPXE server.
+func ipxeBaseURL(cluster talos.Cluster) string {
+	return fmt.Sprintf("http://%s", net.JoinHostPort(cluster.SideroComponentsIP().String(), strconv.Itoa(ipxeHTTPPort)))
+}
+
+// randomMAC generates the MAC address for the unregistered server.
+func randomMAC(t *testing.T) net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+
+	_, err := rand.Read(mac)
+	require.NoError(t, err)
+
+	// locally administered unicast address
+	mac[0] = (mac[0] | 0x02) & 0xfe
+
+	return mac
+}
+
+// fetchIPXE fetches iPXE script for the server and returns kernel and initrd URLs and the kernel args.
+//
+// UUID and MAC are passed in the same way as iPXE does.
+func fetchIPXE(ctx context.Context, t *testing.T, baseURL, serverUUID string, mac net.HardwareAddr) (kernel, initrd *url.URL, args []string) {
+	query := url.Values{}
+	query.Set("uuid", serverUUID)
+	query.Set("mac", strings.ReplaceAll(mac.String(), ":", "-"))
+
+	base, err := url.Parse(baseURL + "/ipxe")
+	require.NoError(t, err)
+
+	base.RawQuery = query.Encode()
+
+	status, body, err := httpGet(ctx, base.String())
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusOK, status)
+
+	script := string(body)
+	require.True(t, strings.HasPrefix(script, "#!ipxe"), "script: %s", script)
+
+	for _, line := range strings.Split(script, "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "kernel":
+			kernel, err = base.Parse(fields[1])
+			require.NoError(t, err)
+
+			args = fields[2:]
+		case "initrd":
+			initrd, err = base.Parse(fields[1])
+			require.NoError(t, err)
+		}
+	}
+
+	require.NotNil(t, kernel, "kernel is missing in the script: %s", script)
+	require.NotNil(t, initrd, "initrd is missing in the script: %s", script)
+
+	return kernel, initrd, args
+}
+
+// assertAgentBoot verifies that the script boots the agent environment, and the agent assets are served.
+func assertAgentBoot(ctx context.Context, t *testing.T, kernel, initrd *url.URL, args []string) {
+	assert.Equal(t, "/env/"+agentEnvironmentName+"/vmlinuz", kernel.Path, "server should boot the agent")
+	assert.Equal(t, "/env/"+agentEnvironmentName+"/initrd", initrd.Path, "server should boot the agent")
+
+	for _, arg := range args {
+		assert.False(t, strings.HasPrefix(arg, "talos.config="), "agent should not be pointed to the machine config")
+	}
+
+	assertAssetsServed(ctx, t, kernel, initrd)
+}
+
+// assertAssetsServed fetches the boot assets the same way iPXE does.
+func assertAssetsServed(ctx context.Context, t *testing.T, assets ...*url.URL) {
+	for _, asset := range assets {
+		status, body, err := httpGet(ctx, asset.String())
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, status, "asset %s", asset)
+		assert.NotEmpty(t, body, "asset %s", asset)
+	}
+}
@@ -29,6 +29,8 @@ import (
 	"github.com/talos-systems/sfyra/pkg/vm"
 )
 
+const installDisk = "/dev/vda"
+
 // TestServerRegistration verifies that all the servers got registered.
 func TestServerRegistration(ctx context.Context, metalClient client.Client, vmSet *vm.Set) TestFunc {
 	return func(t *testing.T) {
@@ -90,8 +92,6 @@ func configPatchToJSON(t *testing.T, o interface{}) []byte {
 // TestServerMgmtAPI patches all the servers for the management API.
 func TestServerMgmtAPI(ctx context.Context, metalClient client.Client, vmSet *vm.Set) TestFunc {
 	return func(t *testing.T) {
-		bridgeIP := vmSet.BridgeIP()
-
 		for _, vm := range vmSet.Nodes() {
 			server := v1alpha1.Server{}
 
@@ -101,7 +101,7 @@ func TestServerMgmtAPI(ctx context.Context, metalClient client.Client, vmSet *vm
 			require.NoError(t, err)
 
 			server.Spec.ManagementAPI = &v1alpha1.ManagementAPI{
-				Endpoint: net.JoinHostPort(bridgeIP.String(), strconv.Itoa(vm.APIPort)),
+				Endpoint: net.JoinHostPort(vmSet.NodeBridgeIP(vm.Name).String(), strconv.Itoa(vm.APIPort)),
 			}
 
 			require.NoError(t, patchHelper.Patch(ctx, &server))
@@ -110,14 +110,16 @@ func TestServerMgmtAPI(ctx context.Context, metalClient client.Client, vmSet *vm
 }
 
 // TestServerPatch patches all the servers for the config.
-func TestServerPatch(ctx context.Context, metalClient client.Client, talosInstaller string, registryMirrors []string) TestFunc {
+//
+//nolint: gocognit
+func TestServerPatch(ctx context.Context, metalClient client.Client, talosInstaller string, registryMirrors, nameservers []string) TestFunc {
 	return func(t *testing.T) {
 		servers := &v1alpha1.ServerList{}
 
 		require.NoError(t, metalClient.List(ctx, servers))
 
 		installConfig := talosconfig.InstallConfig{
-			InstallDisk:       "/dev/vda",
+			InstallDisk:       installDisk,
 			InstallBootloader: true,
 			InstallImage:      talosInstaller,
 			InstallExtraKernelArgs: []string{
@@ -147,8 +149,18 @@ func TestServerPatch(ctx context.Context, metalClient client.Client, talosInstal
 			mirrorsPatch = configPatchToJSON(t, &registriesConfig)
 		}
 
+		var nameserversPatch []byte
+
+		if len(nameservers) > 0 {
+			var err error
+
+			nameserversPatch, err = json.Marshal(nameservers)
+			require.NoError(t, err)
+		}
+
 		for _, server := range servers.Items {
-			if len(server.Spec.ConfigPatches) > 0 {
+			// servers patched by the previous run on the reused environment still need to be accepted
+			if server.Spec.Accepted && len(server.Spec.ConfigPatches) > 0 {
 				continue
 			}
 
@@ -157,18 +169,31 @@ func TestServerPatch(ctx context.Context, metalClient client.Client, talosInstal
 			patchHelper, err := patch.NewHelper(&server, metalClient)
 			require.NoError(t, err)
 
-			server.Spec.ConfigPatches = append(server.Spec.ConfigPatches, v1alpha1.ConfigPatches{
-				Op:    "replace",
-				Path:  "/machine/install",
-				Value: apiextensions.JSON{Raw: installPatch},
-			})
+			// management set servers are accepted explicitly, as auto-accept might be disabled
+			server.Spec.Accepted = true
 
-			if mirrorsPatch != nil {
+			if len(server.Spec.ConfigPatches) == 0 {
 				server.Spec.ConfigPatches = append(server.Spec.ConfigPatches, v1alpha1.ConfigPatches{
-					Op:    "add",
-					Path:  "/machine/registries",
-					Value: apiextensions.JSON{Raw: mirrorsPatch},
+					Op:    "replace",
+					Path:  "/machine/install",
+					Value: apiextensions.JSON{Raw: installPatch},
 				})
+
+				if mirrorsPatch != nil {
+					server.Spec.ConfigPatches = append(server.Spec.ConfigPatches, v1alpha1.ConfigPatches{
+						Op:    "add",
+						Path:  "/machine/registries",
+						Value: apiextensions.JSON{Raw: mirrorsPatch},
+					})
+				}
+
+				if nameserversPatch != nil {
+					server.Spec.ConfigPatches = append(server.Spec.ConfigPatches, v1alpha1.ConfigPatches{
+						Op:    "add",
+						Path:  "/machine/network/nameservers",
+						Value: apiextensions.JSON{Raw: nameserversPatch},
+					})
+				}
 			}
 
 			require.NoError(t, patchHelper.Patch(ctx, &server))
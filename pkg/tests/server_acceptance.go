@@ -0,0 +1,204 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/talos-systems/go-retry/retry"
+	"github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+const acceptanceServerClassName = "acceptance"
+
+// TestServerAcceptance boots the new set of VMs with the auto-accept disabled in Sidero.
+//
+// New servers should register, but they should be available for allocation only once accepted.
+func TestServerAcceptance(ctx context.Context, metalClient client.Client, vmOptions vm.Options) TestFunc {
+	return func(t *testing.T) {
+		if vmOptions.Nodes == 0 {
+			t.Skip("server acceptance test is disabled")
+		}
+
+		serverClass := v1alpha1.ServerClass{}
+		serverClass.APIVersion = "metal.sidero.dev/v1alpha1"
+		serverClass.Name = acceptanceServerClassName
+		serverClass.Spec.Qualifiers.CPU = append(serverClass.Spec.Qualifiers.CPU, qemuCPU)
+
+		if err := metalClient.Create(ctx, &serverClass); err != nil && !apierrors.IsAlreadyExists(err) {
+			require.NoError(t, err)
+		}
+
+		defer metalClient.Delete(ctx, &serverClass) //nolint: errcheck
+
+		vmSet, err := vm.NewSet(ctx, vmOptions)
+		require.NoError(t, err)
+
+		var serverNames []string
+
+		defer func() {
+			assert.NoError(t, vmSet.TearDown(ctx))
+
+			for _, serverName := range serverNames {
+				server := v1alpha1.Server{}
+				server.Name = serverName
+
+				if err = metalClient.Delete(ctx, &server); err != nil && !apierrors.IsNotFound(err) {
+					assert.NoError(t, err)
+				}
+			}
+		}()
+
+		require.NoError(t, vmSet.Setup(ctx))
+
+		for _, node := range vmSet.Nodes() {
+			serverNames = append(serverNames, node.UUID.String())
+		}
+
+		require.NoError(t, retry.Constant(5*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+			for _, serverName := range serverNames {
+				var server v1alpha1.Server
+
+				if err = metalClient.Get(ctx, types.NamespacedName{Name: serverName}, &server); err != nil {
+					if apierrors.IsNotFound(err) {
+						return retry.ExpectedError(fmt.Errorf("server %q is not registered yet", serverName))
+					}
+
+					return retry.UnexpectedError(err)
+				}
+			}
+
+			return nil
+		}))
+
+		for _, serverName := range serverNames {
+			var server v1alpha1.Server
+
+			require.NoError(t, metalClient.Get(ctx, types.NamespacedName{Name: serverName}, &server))
+			assert.False(t, server.Spec.Accepted, "server %q shouldn't be accepted automatically", serverName)
+		}
+
+		// servers pending acceptance should never become available
+		t.Log("verifying that servers are not available until accepted")
+
+		for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); time.Sleep(10 * time.Second) {
+			require.NoError(t, verifyAvailability(ctx, metalClient, nil, serverNames))
+		}
+
+		accepted := serverNames[:(len(serverNames)+1)/2]
+		pending := serverNames[len(accepted):]
+
+		for _, serverName := range accepted {
+			var server v1alpha1.Server
+
+			require.NoError(t, metalClient.Get(ctx, types.NamespacedName{Name: serverName}, &server))
+
+			var patchHelper *patch.Helper
+
+			patchHelper, err = patch.NewHelper(&server, metalClient)
+			require.NoError(t, err)
+
+			server.Spec.Accepted = true
+
+			require.NoError(t, patchHelper.Patch(ctx, &server))
+		}
+
+		require.NoError(t, retry.Constant(5*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+			return verifyAvailability(ctx, metalClient, accepted, pending)
+		}))
+	}
+}
+
+// verifyAvailability checks that the available servers are listed in the ServerClass, while the pending ones are not
+// listed and not allocated.
+func verifyAvailability(ctx context.Context, metalClient client.Client, available, pending []string) error {
+	var serverClass v1alpha1.ServerClass
+
+	if err := metalClient.Get(ctx, types.NamespacedName{Name: acceptanceServerClassName}, &serverClass); err != nil {
+		return retry.UnexpectedError(err)
+	}
+
+	for _, serverName := range pending {
+		if contains(serverClass.Status.ServersAvailable, serverName) || contains(serverClass.Status.ServersInUse, serverName) {
+			return retry.UnexpectedError(fmt.Errorf("server %q is available before being accepted", serverName))
+		}
+
+		var server v1alpha1.Server
+
+		if err := metalClient.Get(ctx, types.NamespacedName{Name: serverName}, &server); err != nil {
+			return retry.UnexpectedError(err)
+		}
+
+		if server.Status.InUse {
+			return retry.UnexpectedError(fmt.Errorf("server %q is allocated before being accepted", serverName))
+		}
+	}
+
+	for _, serverName := range available {
+		if !contains(serverClass.Status.ServersAvailable, serverName) {
+			return retry.ExpectedError(fmt.Errorf("server %q is not available yet", serverName))
+		}
+	}
+
+	return nil
+}
+
+func setAccepted(ctx context.Context, metalClient client.Client, serverName string, accepted bool) error {
+	var server v1alpha1.Server
+
+	if err := metalClient.Get(ctx, types.NamespacedName{Name: serverName}, &server); err != nil {
+		return err
+	}
+
+	patchHelper, err := patch.NewHelper(&server, metalClient)
+	if err != nil {
+		return err
+	}
+
+	server.Spec.Accepted = accepted
+
+	return patchHelper.Patch(ctx, &server)
+}
+
+// waitServersUnavailable waits for the default ServerClass to drop the (unaccepted) servers, so that the cluster
+// deployed afterwards doesn't get them.
+func waitServersUnavailable(ctx context.Context, metalClient client.Client, serverNames []string) error {
+	return retry.Constant(2*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+		var serverClass v1alpha1.ServerClass
+
+		if err := metalClient.Get(ctx, types.NamespacedName{Name: serverClassName}, &serverClass); err != nil {
+			return retry.UnexpectedError(err)
+		}
+
+		for _, serverName := range serverNames {
+			if contains(serverClass.Status.ServersAvailable, serverName) {
+				return retry.ExpectedError(fmt.Errorf("server %q is still available", serverName))
+			}
+		}
+
+		return nil
+	})
+}
+
+func contains(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -24,6 +24,12 @@ import (
 
 const serverClassName = "default"
 
+// qemuCPU qualifier matches all the QEMU VMs.
+var qemuCPU = v1alpha1.CPUInformation{
+	Manufacturer: "QEMU",
+	Version:      "pc-q35-4.2",
+}
+
 // TestServerClassDefault verifies server class creation.
 func TestServerClassDefault(ctx context.Context, metalClient client.Client, vmSet *vm.Set) TestFunc {
 	return func(t *testing.T) {
@@ -36,10 +42,7 @@ func TestServerClassDefault(ctx context.Context, metalClient client.Client, vmSe
 
 			serverClass.APIVersion = "metal.sidero.dev/v1alpha1"
 			serverClass.Name = serverClassName
-			serverClass.Spec.Qualifiers.CPU = append(serverClass.Spec.Qualifiers.CPU, v1alpha1.CPUInformation{
-				Manufacturer: "QEMU",
-				Version:      "pc-q35-4.2",
-			})
+			serverClass.Spec.Qualifiers.CPU = append(serverClass.Spec.Qualifiers.CPU, qemuCPU)
 
 			require.NoError(t, metalClient.Create(ctx, &serverClass))
 		}
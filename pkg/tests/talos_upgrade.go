@@ -0,0 +1,233 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/talos-systems/go-retry/retry"
+	metal "github.com/talos-systems/sidero/app/metal-controller-manager/api/v1alpha1"
+	talosclient "github.com/talos-systems/talos/pkg/machinery/client"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/cluster-api/api/v1alpha3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/talos"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+// TestTalosUpgrade upgrades Talos on the worker node of the management cluster via Talos API.
+//
+// Node should reboot from disk (not PXE), keep the server allocation and rejoin the cluster.
+func TestTalosUpgrade(ctx context.Context, metalClient client.Client, cluster talos.Cluster, vmSet *vm.Set, capiManager *capi.Manager, options Options) TestFunc {
+	return func(t *testing.T) {
+		if options.UpgradeInstallerImage == "" {
+			t.Skip("Talos upgrade installer image is not set")
+		}
+
+		upgradeVersion := installerImageTag(options.UpgradeInstallerImage)
+		require.NotEmpty(t, upgradeVersion, "Talos upgrade installer image should be tagged with the Talos version")
+
+		// keep the control plane endpoint available while the node rejoins the cluster
+		managementCluster, err := NewCluster(ctx, metalClient, cluster, vmSet, capiManager, ClusterOptions{
+			Name:   managementClusterName,
+			LBPort: managementClusterLBPort,
+		})
+		require.NoError(t, err)
+
+		defer managementCluster.Close() //nolint: errcheck
+
+		serversBefore, err := managementCluster.Servers(ctx)
+		require.NoError(t, err)
+
+		machineName, nodeIP := workerNode(ctx, t, managementCluster, vmSet, serversBefore)
+
+		var nodeName string
+
+		for _, node := range vmSet.Nodes() {
+			if node.UUID.String() == serversBefore[machineName] {
+				nodeName = node.Name
+			}
+		}
+
+		consoleLogPath := vmSet.ConsoleLogPath(nodeName)
+
+		kernelBootsBefore, networkBootsBefore, err := consoleBoots(consoleLogPath)
+		require.NoError(t, err)
+
+		talosClient, _, err := managementCluster.TalosClient(ctx)
+		require.NoError(t, err)
+
+		nodeCtx := talosclient.WithNodes(ctx, nodeIP)
+
+		bootIDBefore, err := readFile(nodeCtx, talosClient, "/proc/sys/kernel/random/boot_id")
+		require.NoError(t, err)
+
+		t.Logf("upgrading machine %q (node %s) to %s", machineName, nodeIP, options.UpgradeInstallerImage)
+
+		_, err = talosClient.Upgrade(nodeCtx, options.UpgradeInstallerImage, false)
+		require.NoError(t, err)
+
+		// wait for the node to reboot
+		require.NoError(t, retry.Constant(15*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+			var bootID string
+
+			bootID, err = readFile(nodeCtx, talosClient, "/proc/sys/kernel/random/boot_id")
+			if err != nil {
+				return retry.ExpectedError(err)
+			}
+
+			if bootID == bootIDBefore {
+				return retry.ExpectedError(fmt.Errorf("node %s hasn't rebooted yet", nodeIP))
+			}
+
+			return nil
+		}))
+
+		// firmware logs every network boot to the VM console, so the reboot should add a kernel boot, but no network boots
+		kernelBootsAfter, networkBootsAfter, err := consoleBoots(consoleLogPath)
+		require.NoError(t, err)
+
+		assert.Greater(t, kernelBootsAfter, kernelBootsBefore, "node reboot is not recorded in %q", consoleLogPath)
+		assert.Equal(t, networkBootsBefore, networkBootsAfter, "node should boot from disk, not PXE")
+
+		// node should report the new boot and the Talos version of the installer image via Talos API
+		bootIDAfter, err := readFile(nodeCtx, talosClient, "/proc/sys/kernel/random/boot_id")
+		require.NoError(t, err)
+		assert.NotEqual(t, bootIDBefore, bootIDAfter, "node %s should report the new boot ID", nodeIP)
+
+		version, err := talosClient.Version(nodeCtx)
+		require.NoError(t, err)
+		require.NotEmpty(t, version.Messages, "node %s didn't report the version", nodeIP)
+
+		for _, msg := range version.Messages {
+			assert.Equal(t, upgradeVersion, msg.Version.Tag, "node %s should report the upgraded Talos version", nodeIP)
+		}
+
+		serversAfter, err := managementCluster.Servers(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, serversBefore, serversAfter, "server allocation should be kept")
+
+		var server metal.Server
+
+		require.NoError(t, metalClient.Get(ctx, types.NamespacedName{Name: serversAfter[machineName]}, &server))
+		assert.True(t, server.Status.InUse, "server %q should be in use", server.Name)
+
+		require.NoError(t, managementCluster.Health(ctx))
+
+		clientset, err := managementCluster.KubernetesClient(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, retry.Constant(5*time.Minute, retry.WithUnits(10*time.Second)).Retry(func() error {
+			var nodes *corev1.NodeList
+
+			nodes, err = clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return retry.ExpectedError(err)
+			}
+
+			for _, node := range nodes.Items {
+				for _, cond := range node.Status.Conditions {
+					if cond.Type == corev1.NodeReady && cond.Status != corev1.ConditionTrue {
+						return retry.ExpectedError(fmt.Errorf("node %q is not ready", node.Name))
+					}
+				}
+			}
+
+			return nil
+		}))
+	}
+}
+
+// workerNode returns the name and the IP of the first worker machine of the cluster.
+func workerNode(ctx context.Context, t *testing.T, cluster *Cluster, vmSet *vm.Set, servers map[string]string) (string, string) {
+	machines, err := cluster.Machines(ctx)
+	require.NoError(t, err)
+
+	for _, machine := range machines {
+		if _, ok := machine.Labels[v1alpha3.MachineControlPlaneLabelName]; ok {
+			continue
+		}
+
+		for _, node := range vmSet.Nodes() {
+			if node.UUID.String() == servers[machine.Name] {
+				return machine.Name, node.PrivateIP.String()
+			}
+		}
+	}
+
+	require.FailNow(t, "no worker nodes found", "cluster %q", cluster.Name())
+
+	return "", ""
+}
+
+// installerImageTag returns the tag of the installer image reference, empty if the image is not tagged.
+func installerImageTag(image string) string {
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		return image[idx+1:]
+	}
+
+	return ""
+}
+
+// consoleBoots counts the kernel boots and the network boots recorded in the VM console log.
+//
+// Network boots are started either by the iPXE ROM of the NIC (BIOS), or by OVMF network boot option (UEFI).
+func consoleBoots(consoleLogPath string) (kernelBoots, networkBoots int, err error) {
+	cmdlines, err := bootCmdlines(consoleLogPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	bootOptions, err := uefiBootOptions(consoleLogPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, bootOption := range bootOptions {
+		if isNetworkBootOption(bootOption) {
+			networkBoots++
+		}
+	}
+
+	contents, err := ioutil.ReadFile(consoleLogPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	networkBoots += strings.Count(string(contents), "iPXE initialising devices")
+
+	return len(cmdlines), networkBoots, nil
+}
+
+func readFile(ctx context.Context, talosClient *talosclient.Client, path string) (string, error) {
+	r, errCh, err := talosClient.Read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	defer r.Close() //nolint: errcheck
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	if err = <-errCh; err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
@@ -8,6 +8,7 @@ package tests
 import (
 	"context"
 	"log"
+	"regexp"
 	"testing"
 
 	"github.com/talos-systems/sfyra/pkg/capi"
@@ -20,10 +21,24 @@ type TestFunc func(t *testing.T)
 
 // Options for the test.
 type Options struct {
-	KernelURL, InitrdURL string
-	InstallerImage       string
+	KernelURL, InitrdURL  string
+	InstallerImage        string
+	UpgradeInstallerImage string
 
 	RegistryMirrors []string
+	Nameservers     []string
+
+	KubernetesVersion        string
+	KubernetesVersionMatrix  []string
+	KubernetesUpgradeVersion string
+
+	MultiClusterCount int
+
+	// AcceptanceVMSet configures the set of VMs for the server acceptance test, test is skipped if there are no nodes.
+	AcceptanceVMSet vm.Options
+
+	// ProvidersUpgrade lists provider versions to upgrade to, upgrade test is skipped if empty.
+	ProvidersUpgrade capi.UpgradeOptions
 }
 
 // Run all the tests.
@@ -35,7 +50,7 @@ func Run(ctx context.Context, cluster talos.Cluster, vmSet *vm.Set, capiManager
 		return false
 	}
 
-	return testing.MainStart(matchStringOnly(func(pat, str string) (bool, error) { return true, nil }), []testing.InternalTest{
+	return testing.MainStart(matchStringOnly(regexp.MatchString), []testing.InternalTest{
 		{
 			"TestServerRegistration",
 			TestServerRegistration(ctx, metalClient, vmSet),
@@ -46,7 +61,7 @@ func Run(ctx context.Context, cluster talos.Cluster, vmSet *vm.Set, capiManager
 		},
 		{
 			"TestServerPatch",
-			TestServerPatch(ctx, metalClient, options.InstallerImage, options.RegistryMirrors),
+			TestServerPatch(ctx, metalClient, options.InstallerImage, options.RegistryMirrors, options.Nameservers),
 		},
 		{
 			"TestServersReady",
@@ -62,7 +77,43 @@ func Run(ctx context.Context, cluster talos.Cluster, vmSet *vm.Set, capiManager
 		},
 		{
 			"TestManagementCluster",
-			TestManagementCluster(ctx, metalClient, cluster, vmSet, capiManager),
+			TestManagementCluster(ctx, metalClient, cluster, vmSet, capiManager, options),
+		},
+		{
+			"TestMetadataServer",
+			TestMetadataServer(ctx, metalClient, cluster, vmSet, capiManager, options),
+		},
+		{
+			"TestPXEEndpoints",
+			TestPXEEndpoints(ctx, metalClient, cluster, vmSet, capiManager, options),
+		},
+		{
+			"TestEnvironmentOverride",
+			TestEnvironmentOverride(ctx, metalClient, cluster, vmSet, capiManager, options),
+		},
+		{
+			"TestProvidersUpgrade",
+			TestProvidersUpgrade(ctx, metalClient, cluster, vmSet, capiManager, options),
+		},
+		{
+			"TestMultipleClusters",
+			TestMultipleClusters(ctx, metalClient, cluster, vmSet, capiManager, options),
+		},
+		{
+			"TestTalosUpgrade",
+			TestTalosUpgrade(ctx, metalClient, cluster, vmSet, capiManager, options),
+		},
+		{
+			"TestKubernetesUpgrade",
+			TestKubernetesUpgrade(ctx, metalClient, cluster, vmSet, capiManager, options),
+		},
+		{
+			"TestUEFIServers",
+			TestUEFIServers(ctx, metalClient, cluster, vmSet, capiManager, options),
+		},
+		{
+			"TestServerAcceptance",
+			TestServerAcceptance(ctx, metalClient, options.AcceptanceVMSet),
 		},
 	}, nil, nil).Run() == 0
 }
@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tests
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/talos-systems/sfyra/pkg/capi"
+	"github.com/talos-systems/sfyra/pkg/talos"
+	"github.com/talos-systems/sfyra/pkg/vm"
+)
+
+const (
+	uefiClusterName   = "uefi-cluster"
+	uefiClusterLBPort = 10300
+)
+
+// TestUEFIServers deploys the cluster on the UEFI servers of the management set.
+//
+// Free BIOS servers are temporarily unaccepted, so that the cluster gets the UEFI server. Server should install
+// Talos and reboot into it from disk.
+func TestUEFIServers(ctx context.Context, metalClient client.Client, cluster talos.Cluster, vmSet *vm.Set, capiManager *capi.Manager, options Options) TestFunc {
+	return func(t *testing.T) {
+		nodeNames := serverNodes(vmSet)
+
+		var uefiServers []string
+
+		for serverName, nodeName := range nodeNames {
+			if vmSet.Firmware(nodeName) == vm.FirmwareUEFI {
+				uefiServers = append(uefiServers, serverName)
+			}
+		}
+
+		if len(uefiServers) == 0 {
+			t.Skip("no UEFI servers in the management set")
+		}
+
+		uefiCluster, cleanup := deployCluster(ctx, t, metalClient, cluster, vmSet, capiManager, ClusterOptions{
+			Name:              uefiClusterName,
+			KubernetesVersion: options.KubernetesVersion,
+			ControlPlaneNodes: 1,
+			WorkerNodes:       0,
+			LBPort:            uefiClusterLBPort,
+		}, func(serverName string) bool {
+			return contains(uefiServers, serverName)
+		})
+		defer cleanup()
+
+		t.Log("verifying cluster health")
+
+		require.NoError(t, uefiCluster.Health(ctx))
+
+		allocated, err := uefiCluster.Servers(ctx)
+		require.NoError(t, err)
+		require.NotEmpty(t, allocated)
+
+		for _, serverName := range allocated {
+			require.Contains(t, uefiServers, serverName, "server %q is not a UEFI server", serverName)
+
+			var bootOptions []string
+
+			bootOptions, err = uefiBootOptions(vmSet.ConsoleLogPath(nodeNames[serverName]))
+			require.NoError(t, err)
+
+			// server should PXE boot into the installer, and boot from disk after the install
+			require.GreaterOrEqual(t, len(bootOptions), 2, "server %q: expected network and disk boots, recorded %q", serverName, bootOptions)
+
+			assert.True(t, isNetworkBootOption(bootOptions[0]), "server %q didn't boot from network first: %q", serverName, bootOptions[0])
+			assert.False(t, isNetworkBootOption(bootOptions[len(bootOptions)-1]), "server %q didn't boot from disk: %q", serverName, bootOptions[len(bootOptions)-1])
+		}
+	}
+}
+
+// isNetworkBootOption checks whether the boot option is a network boot.
+//
+// Network boot options are named after the MAC address of the NIC, e.g. "UEFI PXEv4 (MAC:...)".
+func isNetworkBootOption(bootOption string) bool {
+	return strings.Contains(bootOption, "MAC:")
+}
@@ -0,0 +1,164 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package tftp implements minimal TFTP client (RFC 1350) to fetch files the same way PXE firmware does.
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	opRRQ   = 1
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+
+	blockSize = 512
+
+	retransmitTimeout = 2 * time.Second
+	maxRetransmits    = 5
+)
+
+// Error is returned when the server responds with the TFTP error packet.
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tftp error %d: %s", e.Code, e.Message)
+}
+
+// Get fetches the file from the TFTP server in the octet mode.
+//
+// Server address should be in the form `host:port`.
+func Get(ctx context.Context, server, filename string) ([]byte, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close() //nolint: errcheck
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now()) //nolint: errcheck
+		case <-done:
+		}
+	}()
+
+	request := make([]byte, 0, 2+len(filename)+1+len("octet")+1)
+	request = append(request, 0, opRRQ)
+	request = append(request, filename...)
+	request = append(request, 0)
+	request = append(request, "octet"...)
+	request = append(request, 0)
+
+	var (
+		result   bytes.Buffer
+		buf      = make([]byte, 4+blockSize)
+		expected = uint16(1)
+		// server replies from the new port (transfer ID), which is used for the rest of the transfer
+		peer *net.UDPAddr
+		last = request
+	)
+
+	lastAddr := serverAddr
+
+	for retransmits := 0; ; {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if _, err = conn.WriteToUDP(last, lastAddr); err != nil {
+			return nil, err
+		}
+
+		if err = conn.SetReadDeadline(time.Now().Add(retransmitTimeout)); err != nil {
+			return nil, err
+		}
+
+		var (
+			n    int
+			addr *net.UDPAddr
+		)
+
+		n, addr, err = conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			var netErr net.Error
+
+			if errors.As(err, &netErr) && netErr.Timeout() && retransmits < maxRetransmits {
+				retransmits++
+
+				continue
+			}
+
+			return nil, err
+		}
+
+		if peer == nil {
+			peer = addr
+		} else if !addr.IP.Equal(peer.IP) || addr.Port != peer.Port {
+			// packet from the unknown transfer ID, ignore it
+			continue
+		}
+
+		if n < 4 {
+			return nil, fmt.Errorf("short packet from %s", addr)
+		}
+
+		switch binary.BigEndian.Uint16(buf[0:2]) {
+		case opDATA:
+			block := binary.BigEndian.Uint16(buf[2:4])
+
+			if block != expected {
+				// duplicate of the previous block, ACK is resent
+				continue
+			}
+
+			result.Write(buf[4:n])
+
+			last = []byte{0, opACK, buf[2], buf[3]}
+			lastAddr = peer
+			retransmits = 0
+			expected++
+
+			if n-4 < blockSize {
+				// final ACK, server doesn't reply to it
+				if _, err = conn.WriteToUDP(last, lastAddr); err != nil {
+					return nil, err
+				}
+
+				return result.Bytes(), nil
+			}
+		case opERROR:
+			return nil, &Error{
+				Code:    binary.BigEndian.Uint16(buf[2:4]),
+				Message: string(bytes.TrimRight(buf[4:n], "\x00")),
+			}
+		default:
+			return nil, fmt.Errorf("unexpected opcode %d from %s", binary.BigEndian.Uint16(buf[0:2]), addr)
+		}
+	}
+}
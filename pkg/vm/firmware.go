@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vm
+
+import (
+	"fmt"
+	"net"
+)
+
+// Firmware of the PXE-booted VMs.
+type Firmware string
+
+// Firmware options.
+const (
+	// FirmwareBIOS boots VMs with SeaBIOS, iPXE ROM of the NIC chainloads the Sidero boot script over HTTP.
+	FirmwareBIOS Firmware = "bios"
+	// FirmwareUEFI boots VMs with OVMF, iPXE EFI binary is loaded from Sidero TFTP server.
+	FirmwareUEFI Firmware = "uefi"
+	// FirmwareMixed boots half of the VMs (rounded down) with UEFI, and the rest with BIOS.
+	//
+	// UEFI is enabled by the provisioner for the whole cluster, so UEFI VMs are created as a separate cluster
+	// on its own network (Options.UEFICIDR).
+	FirmwareMixed Firmware = "mixed"
+)
+
+// UEFI iPXE binary served by Sidero over TFTP.
+const uefiIPXEBinary = "ipxe.efi"
+
+// ParseFirmware validates the firmware option, empty value defaults to BIOS.
+func ParseFirmware(s string) (Firmware, error) {
+	switch firmware := Firmware(s); firmware {
+	case "":
+		return FirmwareBIOS, nil
+	case FirmwareBIOS, FirmwareUEFI, FirmwareMixed:
+		return firmware, nil
+	default:
+		return "", fmt.Errorf("unknown firmware %q, expected one of %s, %s, %s", s, FirmwareBIOS, FirmwareUEFI, FirmwareMixed)
+	}
+}
+
+// nodeNamePrefix makes node names unique across the clusters of the mixed set.
+func (firmware Firmware) nodeNamePrefix() string {
+	if firmware == FirmwareUEFI {
+		return "pxe-uefi-"
+	}
+
+	return "pxe-"
+}
+
+// ipxeBootFilename returns the DHCP boot filename for the PXE-booted VMs.
+func (firmware Firmware) ipxeBootFilename(bootSource net.IP) string {
+	if firmware == FirmwareUEFI {
+		return uefiIPXEBinary
+	}
+
+	return fmt.Sprintf("http://%s:8081/boot.ipxe", bootSource)
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Health checks that the VM processes of all the nodes of the set are running.
+//
+// Set should be reflected or set up before the check.
+func (set *Set) Health() error {
+	var stopped []string
+
+	for _, node := range set.cluster.Info().ExtraNodes {
+		running, err := set.nodeRunning(node.Name)
+		if err != nil {
+			return err
+		}
+
+		if !running {
+			stopped = append(stopped, node.Name)
+		}
+	}
+
+	if len(stopped) > 0 {
+		return fmt.Errorf("VMs of set %q are not running: %s", set.options.Name, strings.Join(stopped, ", "))
+	}
+
+	if set.uefiSet != nil {
+		return set.uefiSet.Health()
+	}
+
+	return nil
+}
+
+// nodeRunning checks the VM process recorded by the provisioner in the node pid file.
+func (set *Set) nodeRunning(nodeName string) (bool, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(set.stateDir, set.options.Name, nodeName+".pid"))
+	if err != nil {
+		return false, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return false, fmt.Errorf("error parsing pid of %q: %w", nodeName, err)
+	}
+
+	err = syscall.Kill(pid, 0)
+
+	return err == nil || errors.Is(err, syscall.EPERM), nil
+}
@@ -0,0 +1,57 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+)
+
+// MAC addresses of the PXE NIC as printed by the firmware to the console:
+//
+//	iPXE (BIOS): "net0: 52:54:00:12:34:56 using virtio-net on 0000:00:03.0"
+//	OVMF (UEFI): "BdsDxe: loading Boot0001 "UEFI PXEv4 (MAC:525400123456)" ..."
+var (
+	ipxeMACRegexp = regexp.MustCompile(`net0: ([0-9a-fA-F]{2}(?::[0-9a-fA-F]{2}){5})`)
+	ovmfMACRegexp = regexp.MustCompile(`MAC:([0-9a-fA-F]{12})`)
+)
+
+// NodeMAC returns the MAC address of the NIC the VM PXE booted from.
+//
+// Provisioner doesn't report the MACs of the VMs, so the MAC is looked up in the console log.
+func (set *Set) NodeMAC(nodeName string) (net.HardwareAddr, error) {
+	consoleLogPath := set.ConsoleLogPath(nodeName)
+
+	f, err := os.Open(consoleLogPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close() //nolint: errcheck
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		if match := ipxeMACRegexp.FindStringSubmatch(scanner.Text()); match != nil {
+			return net.ParseMAC(match[1])
+		}
+
+		if match := ovmfMACRegexp.FindStringSubmatch(scanner.Text()); match != nil {
+			mac := match[1]
+
+			return net.ParseMAC(fmt.Sprintf("%s:%s:%s:%s:%s:%s", mac[0:2], mac[2:4], mac[4:6], mac[6:8], mac[8:10], mac[10:12]))
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("MAC address of %q is not found in %q", nodeName, consoleLogPath)
+}
@@ -6,9 +6,13 @@ package vm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 
 	talosnet "github.com/talos-systems/net"
 	clientconfig "github.com/talos-systems/talos/pkg/machinery/client/config"
@@ -16,6 +20,7 @@ import (
 	"github.com/talos-systems/talos/pkg/provision/providers/qemu"
 
 	"github.com/talos-systems/sfyra/pkg/constants"
+	"github.com/talos-systems/sfyra/pkg/state"
 )
 
 // Set is a number of PXE-booted VMs.
@@ -25,6 +30,12 @@ type Set struct {
 	options     Options
 	stateDir    string
 	bridgeIP    net.IP
+
+	// uefiSet holds UEFI VMs of the mixed set.
+	uefiSet *Set
+
+	// created is set (atomically) once Setup starts creating the set, including recreation on mismatch.
+	created int32
 }
 
 // Options configure new VM set.
@@ -36,9 +47,57 @@ type Options struct {
 
 	TalosctlPath string
 
+	// Nameservers override default nameservers (constants.Nameservers) if set.
+	Nameservers []net.IP
+
 	MemMB  int64
 	CPUs   int64
 	DiskGB int64
+
+	// Firmware defaults to BIOS.
+	Firmware Firmware
+	// UEFICIDR is the network of the UEFI VMs of the mixed set.
+	UEFICIDR string
+	// UEFINameservers override nameservers of the UEFI VMs of the mixed set, default to Nameservers.
+	UEFINameservers []net.IP
+
+	// RecreateOnMismatch recreates the existing set if it was created with different options.
+	RecreateOnMismatch bool
+}
+
+// savedOptions are the options which can't be changed without recreating the set.
+type savedOptions struct {
+	Nodes      int      `yaml:"nodes"`
+	BootSource string   `yaml:"bootSource"`
+	CIDR       string   `yaml:"cidr"`
+	Firmware   Firmware `yaml:"firmware"`
+
+	Nameservers []string `yaml:"nameservers"`
+
+	MemMB  int64 `yaml:"memMB"`
+	CPUs   int64 `yaml:"cpus"`
+	DiskGB int64 `yaml:"diskGB"`
+}
+
+func (set *Set) savedOptions() savedOptions {
+	nameservers := make([]string, len(set.options.Nameservers))
+
+	for i := range set.options.Nameservers {
+		nameservers[i] = set.options.Nameservers[i].String()
+	}
+
+	return savedOptions{
+		Nodes:      set.options.Nodes,
+		BootSource: set.options.BootSource.String(),
+		CIDR:       set.options.CIDR,
+		Firmware:   set.options.Firmware,
+
+		Nameservers: nameservers,
+
+		MemMB:  set.options.MemMB,
+		CPUs:   set.options.CPUs,
+		DiskGB: set.options.DiskGB,
+	}
 }
 
 // NewSet creates new VM set.
@@ -54,45 +113,141 @@ func NewSet(ctx context.Context, options Options) (*Set, error) {
 		return nil, err
 	}
 
+	if set.options.Firmware, err = ParseFirmware(string(options.Firmware)); err != nil {
+		return nil, err
+	}
+
+	if set.options.Firmware == FirmwareMixed {
+		set.options.Firmware = FirmwareBIOS
+
+		if uefiNodes := options.Nodes / 2; uefiNodes > 0 {
+			uefiOptions := set.options
+			uefiOptions.Name = options.Name + "-uefi"
+			uefiOptions.Nodes = uefiNodes
+			uefiOptions.CIDR = options.UEFICIDR
+			uefiOptions.Firmware = FirmwareUEFI
+
+			if len(options.UEFINameservers) > 0 {
+				uefiOptions.Nameservers = options.UEFINameservers
+			}
+
+			if set.uefiSet, err = NewSet(ctx, uefiOptions); err != nil {
+				return nil, err
+			}
+
+			set.options.Nodes -= uefiNodes
+		}
+	}
+
 	return set, nil
 }
 
 // Setup the VM set.
+//
+// Existing VM set is reused if found, new one is created otherwise.
 func (set *Set) Setup(ctx context.Context) error {
-	var err error
-
-	defaultStateDir, err := clientconfig.GetTalosDirectory()
+	err := set.initPaths()
 	if err != nil {
 		return err
 	}
 
-	set.stateDir = filepath.Join(defaultStateDir, "clusters")
-
 	fmt.Printf("VM set state directory: %s, name: %s\n", set.stateDir, set.options.Name)
 
 	if err = set.findExisting(ctx); err != nil {
 		fmt.Printf("VM set not found: %s, creating new one\n", err)
 
-		return set.create(ctx)
+		err = set.create(ctx)
+	} else {
+		err = set.verifyExisting(ctx)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if set.uefiSet != nil {
+		return set.uefiSet.Setup(ctx)
 	}
 
 	return nil
 }
 
-func (set *Set) findExisting(ctx context.Context) error {
-	var err error
+// verifyExisting checks that the existing set was created with the same options.
+//
+// If the options don't match, the set is recreated if RecreateOnMismatch is set.
+func (set *Set) verifyExisting(ctx context.Context) error {
+	err := state.Verify(set.stateDir, set.options.Name, set.savedOptions())
 
-	set.cluster, err = set.provisioner.Reflect(ctx, set.options.Name, set.stateDir)
+	var mismatch *state.MismatchError
+
+	if !errors.As(err, &mismatch) || !set.options.RecreateOnMismatch {
+		return err
+	}
+
+	fmt.Printf("VM set %s, recreating\n", err)
+
+	if err = set.provisioner.Destroy(ctx, set.cluster); err != nil {
+		return err
+	}
+
+	set.cluster = nil
+
+	return set.create(ctx)
+}
+
+// Verify checks that the set found with Reflect was created with the same options.
+func (set *Set) Verify() error {
+	if err := state.Verify(set.stateDir, set.options.Name, set.savedOptions()); err != nil {
+		return err
+	}
+
+	if set.uefiSet != nil {
+		return set.uefiSet.Verify()
+	}
+
+	return nil
+}
+
+// Reflect finds the existing VM set, it doesn't create a new one.
+func (set *Set) Reflect(ctx context.Context) error {
+	if err := set.initPaths(); err != nil {
+		return err
+	}
+
+	if err := set.findExisting(ctx); err != nil {
+		return fmt.Errorf("VM set %q not found: %w", set.options.Name, err)
+	}
+
+	if set.uefiSet != nil {
+		return set.uefiSet.Reflect(ctx)
+	}
+
+	return nil
+}
+
+func (set *Set) initPaths() error {
+	defaultStateDir, err := clientconfig.GetTalosDirectory()
 	if err != nil {
 		return err
 	}
 
-	_, cidr, err := net.ParseCIDR(set.options.CIDR)
+	set.stateDir = filepath.Join(defaultStateDir, "clusters")
+
+	return nil
+}
+
+func (set *Set) findExisting(ctx context.Context) error {
+	var err error
+
+	set.cluster, err = set.provisioner.Reflect(ctx, set.options.Name, set.stateDir)
 	if err != nil {
 		return err
 	}
 
-	set.bridgeIP, err = talosnet.NthIPInNetwork(cidr, 1)
+	// network comes from the provisioner state, so that existing set is found even if the CIDR option is not resolved
+	cidr := set.cluster.Info().Network.CIDR
+
+	set.bridgeIP, err = talosnet.NthIPInNetwork(&cidr, 1)
 	if err != nil {
 		return err
 	}
@@ -100,7 +255,20 @@ func (set *Set) findExisting(ctx context.Context) error {
 	return nil
 }
 
+// Created returns true if the set (or its UEFI part) was created (or recreated) by Setup rather than reused.
+//
+// Created is safe to call concurrently with Setup.
+func (set *Set) Created() bool {
+	if set.uefiSet != nil && set.uefiSet.Created() {
+		return true
+	}
+
+	return atomic.LoadInt32(&set.created) == 1
+}
+
 func (set *Set) create(ctx context.Context) error {
+	atomic.StoreInt32(&set.created, 1)
+
 	_, cidr, err := net.ParseCIDR(set.options.CIDR)
 	if err != nil {
 		return err
@@ -120,6 +288,11 @@ func (set *Set) create(ctx context.Context) error {
 		}
 	}
 
+	nameservers := constants.Nameservers
+	if len(set.options.Nameservers) > 0 {
+		nameservers = set.options.Nameservers
+	}
+
 	request := provision.ClusterRequest{
 		Name: set.options.Name,
 
@@ -128,7 +301,7 @@ func (set *Set) create(ctx context.Context) error {
 			CIDR:        *cidr,
 			GatewayAddr: set.bridgeIP,
 			MTU:         constants.MTU,
-			Nameservers: constants.Nameservers,
+			Nameservers: nameservers,
 			CNI: provision.CNIConfig{
 				BinPath:  constants.CNIBinPath,
 				ConfDir:  constants.CNIConfDir,
@@ -143,27 +316,49 @@ func (set *Set) create(ctx context.Context) error {
 	for i := 0; i < set.options.Nodes; i++ {
 		request.Nodes = append(request.Nodes,
 			provision.NodeRequest{
-				Name:             fmt.Sprintf("pxe-%d", i),
+				Name:             fmt.Sprintf("%s%d", set.options.Firmware.nodeNamePrefix(), i),
 				IP:               ips[i+1],
 				Memory:           set.options.MemMB * 1024 * 1024,
 				NanoCPUs:         set.options.CPUs * 1000 * 1000 * 1000,
 				DiskSize:         set.options.DiskGB * 1024 * 1024 * 1024,
 				PXEBooted:        true,
 				TFTPServer:       set.options.BootSource.String(),
-				IPXEBootFilename: fmt.Sprintf("http://%s:8081/boot.ipxe", set.options.BootSource),
+				IPXEBootFilename: set.options.Firmware.ipxeBootFilename(set.options.BootSource),
 			})
 	}
 
-	set.cluster, err = set.provisioner.Create(ctx, request)
+	set.cluster, err = set.provisioner.Create(ctx, request, provision.WithUEFI(set.options.Firmware == FirmwareUEFI))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return state.Save(set.stateDir, set.options.Name, set.savedOptions())
 }
 
 // TearDown the set of VMs.
+//
+// If the set wasn't set up (e.g. creation was interrupted), leftovers are looked up in the state directory.
 func (set *Set) TearDown(ctx context.Context) error {
+	if set.uefiSet != nil {
+		if err := set.uefiSet.TearDown(ctx); err != nil {
+			return err
+		}
+	}
+
+	if set.cluster == nil {
+		if err := set.initPaths(); err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(filepath.Join(set.stateDir, set.options.Name)); os.IsNotExist(err) {
+			return nil
+		}
+
+		if err := set.findExisting(ctx); err != nil {
+			return fmt.Errorf("VM set %q state is left in %s: %w", set.options.Name, set.stateDir, err)
+		}
+	}
+
 	if set.cluster != nil {
 		if err := set.provisioner.Destroy(ctx, set.cluster); err != nil {
 			return err
@@ -180,7 +375,42 @@ func (set *Set) BridgeIP() net.IP {
 	return set.bridgeIP
 }
 
+// NodeBridgeIP returns the IP of the gateway (bridge) of the network the VM is attached to.
+//
+// VMs of the mixed set are attached to different networks depending on the firmware.
+func (set *Set) NodeBridgeIP(nodeName string) net.IP {
+	if set.uefiSet != nil && strings.HasPrefix(nodeName, FirmwareUEFI.nodeNamePrefix()) {
+		return set.uefiSet.NodeBridgeIP(nodeName)
+	}
+
+	return set.bridgeIP
+}
+
 // Nodes return information about PXE VMs.
 func (set *Set) Nodes() []provision.NodeInfo {
-	return set.cluster.Info().ExtraNodes
+	nodes := set.cluster.Info().ExtraNodes
+
+	if set.uefiSet != nil {
+		nodes = append(append([]provision.NodeInfo(nil), nodes...), set.uefiSet.Nodes()...)
+	}
+
+	return nodes
+}
+
+// Firmware returns the firmware the VM was booted with.
+func (set *Set) Firmware(nodeName string) Firmware {
+	if set.uefiSet != nil && strings.HasPrefix(nodeName, FirmwareUEFI.nodeNamePrefix()) {
+		return set.uefiSet.Firmware(nodeName)
+	}
+
+	return set.options.Firmware
+}
+
+// ConsoleLogPath returns the path to the serial console log of the VM.
+func (set *Set) ConsoleLogPath(nodeName string) string {
+	if set.uefiSet != nil && strings.HasPrefix(nodeName, FirmwareUEFI.nodeNamePrefix()) {
+		return set.uefiSet.ConsoleLogPath(nodeName)
+	}
+
+	return filepath.Join(set.stateDir, set.options.Name, nodeName+".log")
 }